@@ -3,6 +3,12 @@ set -e
 
 SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
 
+# kaloupile passes the target cluster context; helm reads HELM_KUBECONTEXT itself.
+KUBECTL=(kubectl)
+if [ -n "${KUBE_CONTEXT:-}" ]; then
+    KUBECTL+=(--context "$KUBE_CONTEXT")
+fi
+
 echo "📦 Installing kGateway..."
 
 # Install kGateway CRDs
@@ -23,22 +29,24 @@ echo "✅ kGateway installed"
 echo "📦 Installing Gateway API CRDs..."
 
 # Install Gateway API CRDs (standard channel with experimental features for ListenerSet)
-kubectl apply --server-side -f https://github.com/kubernetes-sigs/gateway-api/releases/download/v1.4.1/experimental-install.yaml
+"${KUBECTL[@]}" apply --server-side -f https://github.com/kubernetes-sigs/gateway-api/releases/download/v1.4.1/experimental-install.yaml
 
 echo "✅ Gateway API CRDs installed"
 
 echo "📦 Installing cert-manager..."
-kubectl apply -f https://github.com/cert-manager/cert-manager/releases/download/v1.19.2/cert-manager.yaml
+"${KUBECTL[@]}" apply -f https://github.com/cert-manager/cert-manager/releases/download/v1.19.2/cert-manager.yaml
 echo "✅ cert-manager installed"
 
 echo "📦 Installing Infomaniak cert-manager webhook..."
-kubectl apply -f https://github.com/infomaniak/cert-manager-webhook-infomaniak/releases/download/v0.2.0/rendered-manifest.yaml
+"${KUBECTL[@]}" apply -f https://github.com/infomaniak/cert-manager-webhook-infomaniak/releases/download/v0.2.0/rendered-manifest.yaml
 echo "✅ Infomaniak cert-manager webhook installed"
 
 # Install kustomization
-kubectl apply -k "$SCRIPT_DIR/"
+"${KUBECTL[@]}" apply -k "$SCRIPT_DIR/"
 
 echo "📦 Installing SeaweedFS S3"
+# The s3-config identities secret and the buckets are managed by kaloupile sync;
+# the filer waits for the secret before starting.
 helm repo add seaweedfs https://seaweedfs.github.io/seaweedfs/helm
 helm upgrade --install seaweedfs seaweedfs/seaweedfs \
   --namespace seaweedfs \
@@ -48,12 +56,8 @@ helm upgrade --install seaweedfs seaweedfs/seaweedfs \
   --set filer.replicaCount=1 \
   --set filer.s3.enabled=true \
   --set filer.s3.enableAuth=true \
-  --set filer.s3.existingConfigSecret=s3-config \
-  --set filer.s3.createBuckets[0].name=dev \
-  --set filer.s3.createBuckets[0].anonymousRead=true
+  --set filer.s3.existingConfigSecret=s3-config
 #   --set s3.enabled=true \
-#   --set s3.createBuckets[0].name=dev \
-#   --set s3.createBuckets[0].anonymousRead=true \
 #   --set s3.existingConfigSecret=s3-config \
   
 echo "✅ SeaweedFS S3 installed"
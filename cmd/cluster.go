@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"github.com/yyewolf/kaloupile/pkg/kind"
+)
+
+type clusterFlags struct {
+	exclusive bool
+	yes       bool
+}
+
+func (f *clusterFlags) register(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&f.exclusive, "exclusive", false, "Delete other kind clusters created by kaloupile (asks for confirmation)")
+	cmd.Flags().BoolVarP(&f.yes, "yes", "y", false, "Do not ask for confirmation")
+}
+
+func (f *clusterFlags) ensureCluster(cfg *config.Config) func() error {
+	return func() error {
+		return kind.EnsureClusterWith(cfg, kind.EnsureOptions{
+			Exclusive: f.exclusive,
+			Confirm: func(clusters []string) bool {
+				if f.yes {
+					return true
+				}
+				return confirm(fmt.Sprintf("Delete %d kind cluster(s)?", len(clusters)))
+			},
+		})
+	}
+}
+
+// confirm asks a yes/no question on stdin and defaults to no.
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		fmt.Println()
+		return false
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"gopkg.in/yaml.v3"
+)
+
+//go:generate go run . config schema --output ../config.schema.json
+
+func newConfigCommand(configPaths *[]string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the effective config",
+	}
+
+	cmd.AddCommand(newConfigViewCommand(configPaths))
+	cmd.AddCommand(newConfigValidateCommand(configPaths))
+	cmd.AddCommand(newConfigSchemaCommand())
+
+	return cmd
+}
+
+func newConfigViewCommand(configPaths *[]string) *cobra.Command {
+	var showSecrets bool
+
+	cmd := &cobra.Command{
+		Use:   "view",
+		Short: "Print the merged config with secrets redacted",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Not validated, so an invalid config can still be inspected.
+			cfg, err := config.LoadFromFile(defaultConfigPath, *configPaths...)
+			if err != nil {
+				return err
+			}
+
+			view := cfg
+			if !showSecrets {
+				view, err = cfg.Redacted()
+				if err != nil {
+					return err
+				}
+			}
+
+			fmt.Printf("# merged from: %s\n", strings.Join(cfg.Files(), ", "))
+			encoder := yaml.NewEncoder(os.Stdout)
+			encoder.SetIndent(2)
+			if err := encoder.Encode(view); err != nil {
+				return fmt.Errorf("encode config: %w", err)
+			}
+			return encoder.Close()
+		},
+	}
+
+	cmd.Flags().BoolVar(&showSecrets, "show-secrets", false, "Print secrets in clear, e.g. for the Tiltfile to hand them to service Tiltfiles")
+
+	return cmd
+}
+
+func newConfigValidateCommand(configPaths *[]string) *cobra.Command {
+	return &cobra.Command{
+		Use:          "validate",
+		Short:        "Validate the merged config and report every problem",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.LoadFromFile(defaultConfigPath, *configPaths...)
+			if err != nil {
+				return err
+			}
+			if err := config.Validate(cfg); err != nil {
+				return err
+			}
+
+			printWarnings(cfg)
+			fmt.Printf("config is valid (%s)\n", strings.Join(cfg.Files(), ", "))
+			return nil
+		},
+	}
+}
+
+func newConfigSchemaCommand() *cobra.Command {
+	var (
+		output string
+		check  string
+	)
+
+	cmd := &cobra.Command{
+		Use:          "schema",
+		Short:        "Print the JSON Schema of config.yml",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			schema, err := config.Schema()
+			if err != nil {
+				return err
+			}
+
+			if check != "" {
+				current, err := os.ReadFile(check)
+				if err != nil {
+					return fmt.Errorf("read schema %s: %w", check, err)
+				}
+				if !bytes.Equal(current, schema) {
+					return fmt.Errorf("%s is out of date with config.Config, regenerate it with `go generate ./cmd`", check)
+				}
+				fmt.Printf("%s is up to date\n", check)
+				return nil
+			}
+
+			if output != "" {
+				if err := os.WriteFile(output, schema, 0o644); err != nil {
+					return fmt.Errorf("write schema %s: %w", output, err)
+				}
+				return nil
+			}
+
+			_, err = os.Stdout.Write(schema)
+			return err
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "", "Write the schema to a file instead of stdout")
+	cmd.Flags().StringVar(&check, "check", "", "Fail if the given schema file differs from the generated schema")
+
+	return cmd
+}
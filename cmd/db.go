@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yyewolf/kaloupile/pkg/sync"
+)
+
+func newDBCommand(configPaths *[]string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "db",
+		Short: "Manage the PostgreSQL databases of postgres.users",
+	}
+
+	cmd.AddCommand(newDBReseedCommand(configPaths))
+	cmd.AddCommand(newDBSnapshotCommand(configPaths))
+	cmd.AddCommand(newDBRestoreCommand(configPaths))
+	cmd.AddCommand(newDBSnapshotsCommand(configPaths))
+
+	return cmd
+}
+
+func newDBReseedCommand(configPaths *[]string) *cobra.Command {
+	var (
+		syncFlags syncFlags
+		yes       bool
+	)
+
+	cmd := &cobra.Command{
+		Use:          "reseed <db>",
+		Short:        "Drop a database, recreate it and replay its seed files",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dbName := args[0]
+
+			logStep("load config")
+			cfg, err := loadConfig(*configPaths)
+			if err != nil {
+				return err
+			}
+			logDone("load config")
+
+			if !yes && !confirm(fmt.Sprintf("Drop database %s and all its data?", dbName)) {
+				return fmt.Errorf("reseed of %s not confirmed", dbName)
+			}
+
+			return runStep("reseed "+dbName, func() error {
+				return sync.ReseedDatabase(cfg, dbName, syncFlags.options())
+			})
+		},
+	}
+
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Do not ask for confirmation")
+	syncFlags.register(cmd)
+
+	return cmd
+}
+
+func newDBSnapshotCommand(configPaths *[]string) *cobra.Command {
+	var (
+		syncFlags syncFlags
+		export    string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "snapshot <db> [name]",
+		Short: "Copy a database into an in-cluster snapshot, named after the current time by default",
+		Long: "Copy a database into an in-cluster snapshot with CREATE DATABASE ... TEMPLATE.\n" +
+			"Sessions on the database are closed first. Snapshots are stored in postgresql-pvc\n" +
+			"and are lost with it.",
+		Args:         cobra.RangeArgs(1, 2),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dbName := args[0]
+			name := ""
+			if len(args) > 1 {
+				name = args[1]
+			}
+
+			logStep("load config")
+			cfg, err := loadConfig(*configPaths)
+			if err != nil {
+				return err
+			}
+			logDone("load config")
+
+			return runStep("snapshot "+dbName, func() error {
+				snapshot, err := sync.SnapshotDatabase(cfg, dbName, name, export, syncFlags.options())
+				if err != nil {
+					return err
+				}
+				fmt.Printf("[postgresql] snapshot %s of %s taken (%s)\n", snapshot.Name, snapshot.Database, formatSize(snapshot.Size))
+				return nil
+			})
+		},
+	}
+
+	cmd.Flags().StringVar(&export, "export", "", "Also write the snapshot to this host file in pg_dump custom format (restore it with pg_restore)")
+	syncFlags.register(cmd)
+
+	return cmd
+}
+
+func newDBRestoreCommand(configPaths *[]string) *cobra.Command {
+	var (
+		syncFlags syncFlags
+		yes       bool
+	)
+
+	cmd := &cobra.Command{
+		Use:          "restore <db> <name>",
+		Short:        "Replace a database with a copy of one of its snapshots",
+		Args:         cobra.ExactArgs(2),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dbName, name := args[0], args[1]
+
+			logStep("load config")
+			cfg, err := loadConfig(*configPaths)
+			if err != nil {
+				return err
+			}
+			logDone("load config")
+
+			if !yes && !confirm(fmt.Sprintf("Replace database %s with snapshot %s?", dbName, name)) {
+				return fmt.Errorf("restore of %s not confirmed", dbName)
+			}
+
+			return runStep("restore "+dbName, func() error {
+				return sync.RestoreDatabase(cfg, dbName, name, syncFlags.options())
+			})
+		},
+	}
+
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Do not ask for confirmation")
+	syncFlags.register(cmd)
+
+	return cmd
+}
+
+func newDBSnapshotsCommand(configPaths *[]string) *cobra.Command {
+	var syncFlags syncFlags
+
+	cmd := &cobra.Command{
+		Use:          "snapshots [db]",
+		Short:        "List the snapshots of a database, or of every database",
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dbName := ""
+			if len(args) > 0 {
+				dbName = args[0]
+			}
+
+			cfg, err := loadConfig(*configPaths)
+			if err != nil {
+				return err
+			}
+
+			snapshots, err := sync.ListSnapshots(cfg, dbName, syncFlags.options())
+			if err != nil {
+				return err
+			}
+			if len(snapshots) == 0 {
+				fmt.Fprintln(os.Stderr, "no snapshots")
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "DATABASE\tNAME\tTAKEN\tSIZE")
+			for _, snapshot := range snapshots {
+				taken := "unknown"
+				if !snapshot.Taken.IsZero() {
+					taken = snapshot.Taken.Local().Format(time.DateTime)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", snapshot.Database, snapshot.Name, taken, formatSize(snapshot.Size))
+			}
+			return w.Flush()
+		},
+	}
+
+	syncFlags.register(cmd)
+
+	return cmd
+}
+
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	value, exponent := float64(bytes)/unit, 0
+	for value >= unit && exponent < 3 {
+		value /= unit
+		exponent++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGT"[exponent])
+}
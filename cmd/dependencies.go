@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/yyewolf/kaloupile/pkg/dependencies"
+)
+
+func newDependenciesCommand(configPaths *[]string) *cobra.Command {
+	var only []string
+	var waitFlags waitFlags
+	var resetData bool
+
+	cmd := &cobra.Command{
+		Use:   "dependencies",
+		Short: "Install dependencies according to config",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logStep("load config")
+			cfg, err := loadConfig(*configPaths)
+			if err != nil {
+				return err
+			}
+			deps, err := dependencies.Selected(cfg, only)
+			if err != nil {
+				return err
+			}
+			if err := dependencies.Validate(cfg, deps); err != nil {
+				return err
+			}
+			logDone("load config")
+
+			for _, dep := range deps {
+				if resetter, ok := dep.(dependencies.DataResetter); ok && resetData {
+					if err := runStep("reset "+dep.Name()+" data", func() error {
+						return resetter.ResetData(cfg)
+					}); err != nil {
+						return err
+					}
+				}
+				if err := runStep("install "+dep.Name(), waitFlags.installDependency(cfg, dep)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringSliceVar(&only, "only", nil, fmt.Sprintf("Only install the given dependencies (%v)", dependencies.Names()))
+	cmd.Flags().BoolVar(&resetData, "reset-data", false, "Delete the data of the selected dependencies, e.g. postgresql-pvc, and start them from scratch")
+	waitFlags.register(cmd)
+	cmd.AddCommand(newDependenciesUninstallCommand(configPaths))
+
+	return cmd
+}
+
+func newDependenciesUninstallCommand(configPaths *[]string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "uninstall <dependency>...",
+		Short: "Uninstall dependencies from the cluster",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logStep("load config")
+			cfg, err := loadConfig(*configPaths)
+			if err != nil {
+				return err
+			}
+			logDone("load config")
+
+			for _, name := range args {
+				dep, ok := dependencies.Get(name)
+				if !ok {
+					return fmt.Errorf("unknown dependency %q (known: %v)", name, dependencies.Names())
+				}
+				if err := runStep("uninstall "+name, func() error {
+					return dep.Uninstall(cfg)
+				}); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"github.com/yyewolf/kaloupile/pkg/doctor"
+)
+
+func newDoctorCommand(configPaths *[]string) *cobra.Command {
+	return &cobra.Command{
+		Use:          "doctor",
+		Short:        "Check host tooling, the docker daemon and host ports",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Validation is reported as one of the checks, so that the
+			// others still run on an invalid config.
+			cfg, err := config.LoadFromFile(defaultConfigPath, *configPaths...)
+			if err != nil {
+				return err
+			}
+
+			checks := doctor.Run(cfg)
+			for _, check := range checks {
+				state := "ok"
+				if !check.OK {
+					state = "FAIL"
+				}
+				fmt.Printf("[%s] %s: %s\n", state, check.Name, check.Detail)
+				if check.Hint != "" {
+					fmt.Printf("       hint: %s\n", check.Hint)
+				}
+			}
+
+			return doctor.Err(checks)
+		},
+	}
+}
@@ -7,10 +7,10 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/yyewolf/kaloupile/pkg/config"
-	"github.com/yyewolf/kaloupile/pkg/dependencies"
+	_ "github.com/yyewolf/kaloupile/pkg/dependencies/all"
 	"github.com/yyewolf/kaloupile/pkg/kind"
+	"github.com/yyewolf/kaloupile/pkg/pipeline"
 	"github.com/yyewolf/kaloupile/pkg/routes"
-	"github.com/yyewolf/kaloupile/pkg/sync"
 )
 
 const defaultConfigPath = "config.yml"
@@ -18,86 +18,73 @@ const defaultConfigPath = "config.yml"
 func main() {
 	root := newRootCommand()
 	if err := root.Execute(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, config.Redact(err.Error()))
 		os.Exit(1)
 	}
 }
 
 func newRootCommand() *cobra.Command {
-	var configPath string
+	var configPaths []string
 
 	cmd := &cobra.Command{
 		Use:   "kaloupile",
 		Short: "Kaloupile cluster management",
+		// Errors are printed by main once secrets are redacted.
+		SilenceErrors: true,
 	}
 
-	cmd.PersistentFlags().StringVar(&configPath, "config", defaultConfigPath, "Path to config.yml")
+	cmd.PersistentFlags().StringArrayVar(&configPaths, "config", nil, "Config file merged over config.yml and config.local.yml (repeatable, later files win)")
 
-	cmd.AddCommand(newSetupCommand())
-	cmd.AddCommand(newDependenciesCommand(&configPath))
-	cmd.AddCommand(newRoutesCommand(&configPath))
-	cmd.AddCommand(newSyncCommand(&configPath))
-	cmd.AddCommand(newCleanupCommand())
+	cmd.AddCommand(newSetupCommand(&configPaths))
+	cmd.AddCommand(newDependenciesCommand(&configPaths))
+	cmd.AddCommand(newRoutesCommand(&configPaths))
+	cmd.AddCommand(newSyncCommand(&configPaths))
+	cmd.AddCommand(newDBCommand(&configPaths))
+	cmd.AddCommand(newCleanupCommand(&configPaths))
+	cmd.AddCommand(newUpCommand(&configPaths))
+	cmd.AddCommand(newStatusCommand(&configPaths))
+	cmd.AddCommand(newDoctorCommand(&configPaths))
+	cmd.AddCommand(newConfigCommand(&configPaths))
 
 	return cmd
 }
 
-func newSetupCommand() *cobra.Command {
-	return &cobra.Command{
+func newSetupCommand(configPaths *[]string) *cobra.Command {
+	var clusterFlags clusterFlags
+	var waitFlags waitFlags
+
+	cmd := &cobra.Command{
 		Use:   "setup",
 		Short: "Install prerequisites and create the kind cluster",
-		RunE: func(cmd *cobra.Command, args []string) error {
-			if err := runStep("ensure kind cluster", kind.EnsureCluster); err != nil {
-				return err
-			}
-
-			return runStep("install prerequisites", kind.InstallPrerequisites)
-		},
-	}
-}
-
-func newDependenciesCommand(configPath *string) *cobra.Command {
-	return &cobra.Command{
-		Use:   "dependencies",
-		Short: "Install dependencies according to config",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			logStep("load config")
-			cfg, err := config.LoadFromFile(*configPath)
+			cfg, err := loadConfig(*configPaths)
 			if err != nil {
 				return err
 			}
-			if err := config.ValidateDependencies(cfg); err != nil {
-				return err
-			}
 			logDone("load config")
 
-			if err := runStep("install cert-manager dependencies", func() error {
-				return dependencies.InstallCertManagerDependencies(cfg)
-			}); err != nil {
-				return err
-			}
-
-			if err := runStep("install postgresql", func() error {
-				return dependencies.InstallPostgreSQL(cfg)
-			}); err != nil {
-				return err
-			}
-			if err := runStep("install fake smtp", dependencies.InstallFakeSMTP); err != nil {
+			if err := runStep("ensure kind cluster", clusterFlags.ensureCluster(cfg)); err != nil {
 				return err
 			}
 
-			return nil
+			return runStep("install prerequisites", waitFlags.installPrerequisites(cfg))
 		},
 	}
+
+	clusterFlags.register(cmd)
+	waitFlags.register(cmd)
+
+	return cmd
 }
 
-func newRoutesCommand(configPath *string) *cobra.Command {
+func newRoutesCommand(configPaths *[]string) *cobra.Command {
 	return &cobra.Command{
 		Use:   "routes",
 		Short: "Install routes for apps",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			logStep("load config")
-			cfg, err := config.LoadFromFile(*configPath)
+			cfg, err := loadConfig(*configPaths)
 			if err != nil {
 				return err
 			}
@@ -110,32 +97,46 @@ func newRoutesCommand(configPath *string) *cobra.Command {
 	}
 }
 
-func newSyncCommand(configPath *string) *cobra.Command {
+func newCleanupCommand(configPaths *[]string) *cobra.Command {
 	return &cobra.Command{
-		Use:   "sync",
-		Short: "Run sync tasks (e.g. PostgreSQL users/databases)",
+		Use:   "cleanup",
+		Short: "Delete the kind cluster",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			logStep("load config")
-			cfg, err := config.LoadFromFile(*configPath)
+			cfg, err := loadConfig(*configPaths)
 			if err != nil {
 				return err
 			}
 			logDone("load config")
 
-			return runStep("sync postgresql", func() error {
-				return sync.SyncPostgreSQL(cfg)
-			})
+			if err := runStep("delete kind cluster", func() error {
+				return kind.DeleteCluster(cfg)
+			}); err != nil {
+				return err
+			}
+
+			return pipeline.ResetState(pipelineStatePath(cfg))
 		},
 	}
 }
 
-func newCleanupCommand() *cobra.Command {
-	return &cobra.Command{
-		Use:   "cleanup",
-		Short: "Delete the kind cluster",
-		RunE: func(cmd *cobra.Command, args []string) error {
-			return runStep("delete kind cluster", kind.DeleteCluster)
-		},
+// loadConfig merges config.yml, config.local.yml and the --config files,
+// validates the result and prints its warnings.
+func loadConfig(overrides []string) (*config.Config, error) {
+	cfg, err := config.LoadFromFile(defaultConfigPath, overrides...)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Validate(cfg); err != nil {
+		return nil, err
+	}
+	printWarnings(cfg)
+	return cfg, nil
+}
+
+func printWarnings(cfg *config.Config) {
+	for _, problem := range config.Warnings(cfg) {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", problem)
 	}
 }
 
@@ -164,5 +165,5 @@ func logDoneWithDuration(name string, elapsed time.Duration) {
 }
 
 func logFail(name string, err error) {
-	fmt.Printf("<== %s failed: %v\n", name, err)
+	fmt.Printf("<== %s failed: %s\n", name, config.Redact(err.Error()))
 }
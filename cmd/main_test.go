@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/yyewolf/kaloupile/pkg/config"
+)
+
+// closedPort returns a local port nothing listens on.
+func closedPort(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+	return strconv.Itoa(port)
+}
+
+// runCommand runs the CLI with args and returns what it wrote to stdout and
+// stderr.
+func runCommand(t *testing.T, args ...string) (string, string) {
+	t.Helper()
+
+	outReader, outWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errReader, errWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = outWriter, errWriter
+	defer func() { os.Stdout, os.Stderr = stdout, stderr }()
+
+	outDone := make(chan string)
+	errDone := make(chan string)
+	go func() { data, _ := io.ReadAll(outReader); outDone <- string(data) }()
+	go func() { data, _ := io.ReadAll(errReader); errDone <- string(data) }()
+
+	root := newRootCommand()
+	root.SetArgs(args)
+	// Failing checks are expected without a cluster, only the output matters.
+	_ = root.Execute()
+
+	_ = outWriter.Close()
+	_ = errWriter.Close()
+	return <-outDone, <-errDone
+}
+
+// chdirWithWarnings moves to a copy of the repository config whose service
+// paths do not exist, so that loading it prints warnings, and points every
+// client at closed ports.
+func chdirWithWarnings(t *testing.T) {
+	t.Helper()
+	data, err := os.ReadFile("../config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "config.yml"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+
+	t.Setenv("PATH", t.TempDir())
+	t.Setenv("PGHOST", "127.0.0.1")
+	t.Setenv("PGPORT", closedPort(t))
+	t.Setenv("S3_ENDPOINT", "http://127.0.0.1:"+closedPort(t))
+}
+
+func TestStatusJSONStdoutIgnoresWarnings(t *testing.T) {
+	chdirWithWarnings(t)
+
+	stdout, stderr := runCommand(t, "status", "-o", "json")
+	if !strings.Contains(stderr, "warning: ") {
+		t.Fatalf("expected config warnings on stderr, got %q", stderr)
+	}
+	var report map[string]any
+	if err := json.Unmarshal([]byte(stdout), &report); err != nil {
+		t.Fatalf("status -o json stdout is not JSON: %v\n%s", err, stdout)
+	}
+}
+
+func TestSyncPlanStdoutIgnoresWarnings(t *testing.T) {
+	chdirWithWarnings(t)
+
+	stdout, stderr := runCommand(t, "sync", "--plan", "--retry-timeout", "0")
+	if !strings.Contains(stderr, "warning: ") {
+		t.Fatalf("expected config warnings on stderr, got %q", stderr)
+	}
+	if strings.Contains(stdout, "warning") {
+		t.Fatalf("sync --plan stdout carries warnings:\n%s", stdout)
+	}
+}
+
+func TestConfigValidateReportsUnknownDependencies(t *testing.T) {
+	chdirWithWarnings(t)
+	local := "dependencies:\n  redsi:\n    enabled: false\n  postgresq:\n    enabled: true\n"
+	if err := os.WriteFile("config.local.yml", []byte(local), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := loadConfig(nil)
+	var validationErr *config.ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("loadConfig = %v, want a *config.ValidationError", err)
+	}
+	var got []string
+	for _, problem := range validationErr.Problems {
+		got = append(got, problem.Position+" "+problem.Path)
+	}
+	want := []string{"config.local.yml:4 dependencies.postgresq", "config.local.yml:2 dependencies.redsi"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("problems = %v, want %v", got, want)
+	}
+
+	root := newRootCommand()
+	root.SetArgs([]string{"config", "validate"})
+	if validateErr := root.Execute(); validateErr == nil || validateErr.Error() != err.Error() {
+		t.Fatalf("config validate = %v, want the loadConfig error:\n%v", validateErr, err)
+	}
+}
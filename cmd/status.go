@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/yyewolf/kaloupile/pkg/status"
+)
+
+func newStatusCommand(configPaths *[]string) *cobra.Command {
+	var output string
+
+	cmd := &cobra.Command{
+		Use:          "status",
+		Short:        "Report health of the cluster, dependencies, routes and sync targets",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if output != "table" && output != "json" {
+				return fmt.Errorf("unsupported output format %q (expected table or json)", output)
+			}
+
+			cfg, err := loadConfig(*configPaths)
+			if err != nil {
+				return err
+			}
+
+			report, err := status.Collect(cfg)
+			if err != nil {
+				return err
+			}
+
+			if output == "json" {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				if err := encoder.Encode(report); err != nil {
+					return err
+				}
+			} else {
+				printStatusTable(report)
+			}
+
+			if !report.Healthy {
+				return fmt.Errorf("%d of %d checks unhealthy", report.Unhealthy(), len(report.Checks))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "table", "Output format: table or json")
+
+	return cmd
+}
+
+func printStatusTable(report *status.Report) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COMPONENT\tNAME\tSTATUS\tDETAIL")
+	for _, check := range report.Checks {
+		state := "ok"
+		if !check.Healthy {
+			state = "FAIL"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", check.Component, check.Name, state, check.Detail)
+	}
+	_ = w.Flush()
+}
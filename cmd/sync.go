@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"github.com/yyewolf/kaloupile/pkg/dependencies"
+	postgresdep "github.com/yyewolf/kaloupile/pkg/dependencies/postgresql"
+	redisdep "github.com/yyewolf/kaloupile/pkg/dependencies/redis"
+	"github.com/yyewolf/kaloupile/pkg/sync"
+)
+
+// syncTarget is one reconciliation run by sync and by the up pipeline.
+type syncTarget struct {
+	name string
+	// after names the target that must run first, if any.
+	after  string
+	inputs []string
+	// configInputs lists further inputs found in the config, if any.
+	configInputs func(cfg *config.Config) []string
+	// always makes up run the target every time, for state that is lost
+	// without the config changing.
+	always  bool
+	enabled func(cfg *config.Config) bool
+	run     func(cfg *config.Config, opts sync.Options) error
+}
+
+type syncFlags struct {
+	retryTimeout time.Duration
+}
+
+func (f *syncFlags) register(cmd *cobra.Command) {
+	cmd.Flags().DurationVar(&f.retryTimeout, "retry-timeout", sync.DefaultRetryTimeout, "How long sync retries transient failures such as an unreachable server (0 disables retries)")
+}
+
+func (f *syncFlags) options() sync.Options {
+	return sync.Options{RetryTimeout: f.retryTimeout}
+}
+
+var syncTargets = []syncTarget{
+	{
+		name: "postgresql",
+		enabled: func(cfg *config.Config) bool {
+			return dependencies.IsEnabledByName(cfg, postgresdep.Name)
+		},
+		run: sync.SyncPostgreSQL,
+	},
+	{
+		name:         "postgresql-seeds",
+		after:        "postgresql",
+		configInputs: sync.SeedDirectories,
+		enabled: func(cfg *config.Config) bool {
+			return dependencies.IsEnabledByName(cfg, postgresdep.Name) && len(sync.SeedDirectories(cfg)) > 0
+		},
+		run: sync.SyncPostgreSQLSeeds,
+	},
+	{
+		name: "redis",
+		// Redis keeps its ACL users in memory only, so they are gone after
+		// the pod restarts.
+		always: true,
+		enabled: func(cfg *config.Config) bool {
+			return dependencies.IsEnabledByName(cfg, redisdep.Name)
+		},
+		run: sync.SyncRedis,
+	},
+	{name: "s3-identities", inputs: []string{sync.S3SecretsTemplatePath}, run: sync.SyncS3Identities},
+	{name: "s3-buckets", after: "s3-identities", run: sync.SyncS3Buckets},
+}
+
+func syncTargetNames() []string {
+	names := make([]string, 0, len(syncTargets))
+	for _, target := range syncTargets {
+		names = append(names, target.name)
+	}
+	return names
+}
+
+func enabledSyncTargets(cfg *config.Config) []syncTarget {
+	var targets []syncTarget
+	for _, target := range syncTargets {
+		if target.enabled == nil || target.enabled(cfg) {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// selectedSyncTargets returns the enabled targets, or exactly the named ones
+// when only is set.
+func selectedSyncTargets(cfg *config.Config, only []string) ([]syncTarget, error) {
+	if len(only) == 0 {
+		return enabledSyncTargets(cfg), nil
+	}
+
+	wanted := make(map[string]bool, len(only))
+	for _, name := range only {
+		wanted[name] = true
+	}
+
+	var targets []syncTarget
+	for _, target := range syncTargets {
+		if wanted[target.name] {
+			targets = append(targets, target)
+			delete(wanted, target.name)
+		}
+	}
+	if len(wanted) > 0 {
+		var unknown []string
+		for _, name := range only {
+			if wanted[name] {
+				unknown = append(unknown, name)
+			}
+		}
+		return nil, fmt.Errorf("unknown sync target %s (known: %v)", strings.Join(unknown, ", "), syncTargetNames())
+	}
+	return targets, nil
+}
+
+func newSyncCommand(configPaths *[]string) *cobra.Command {
+	var (
+		only      []string
+		syncFlags syncFlags
+		prune     bool
+		plan      bool
+		yes       bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "sync",
+		Short: "Run sync tasks (PostgreSQL users/databases and seeds, Redis ACL users, S3 identities and buckets)",
+		// A pending plan is reported as an error; usage would only bury it.
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if plan {
+				return runPlan(*configPaths, only, syncFlags.options(), prune)
+			}
+
+			logStep("load config")
+			cfg, err := loadConfig(*configPaths)
+			if err != nil {
+				return err
+			}
+			targets, err := selectedSyncTargets(cfg, only)
+			if err != nil {
+				return err
+			}
+			logDone("load config")
+
+			opts := syncFlags.options()
+			opts.Prune = prune
+			opts.ConfirmPrune = func(objects []sync.PruneObject) bool {
+				return yes || confirm(fmt.Sprintf("Drop %d object(s)?", len(objects)))
+			}
+
+			for _, target := range targets {
+				if err := runStep("sync "+target.name, func() error {
+					return target.run(cfg, opts)
+				}); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringSliceVar(&only, "only", nil, fmt.Sprintf("Only run the given sync targets %v", syncTargetNames()))
+	cmd.Flags().BoolVar(&prune, "prune", false, "Drop the PostgreSQL roles and databases created by kaloupile that are no longer in config (asks for confirmation)")
+	cmd.Flags().BoolVar(&plan, "plan", false, "Print the SQL the PostgreSQL sync would run without running it; exits non-zero when changes are pending")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Do not ask for confirmation")
+	syncFlags.register(cmd)
+
+	return cmd
+}
+
+// runPlan prints the PostgreSQL sync plan as a psql script on stdout, so it can
+// be reviewed or piped, and fails when it is not empty. Only the postgresql
+// target has a plan, so --only must name it alone.
+func runPlan(configPaths []string, only []string, opts sync.Options, prune bool) error {
+	cfg, err := loadConfig(configPaths)
+	if err != nil {
+		return err
+	}
+	if _, err := selectedSyncTargets(cfg, only); err != nil {
+		return err
+	}
+	for _, name := range only {
+		if name != "postgresql" {
+			return fmt.Errorf("--plan only covers the postgresql sync target, not %s", name)
+		}
+	}
+	if !dependencies.IsEnabledByName(cfg, postgresdep.Name) {
+		return fmt.Errorf("dependency %s is disabled in config, there is nothing to plan", postgresdep.Name)
+	}
+
+	opts.Prune = prune
+	statements, err := sync.PlanPostgreSQL(cfg, opts)
+	if err != nil {
+		return err
+	}
+	if len(statements) == 0 {
+		fmt.Fprintln(os.Stderr, "postgresql is up to date")
+		return nil
+	}
+
+	if err := sync.WritePlan(os.Stdout, cfg, statements); err != nil {
+		return err
+	}
+	return fmt.Errorf("%d pending postgresql change(s)", len(statements))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+
+	"github.com/spf13/cobra"
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"github.com/yyewolf/kaloupile/pkg/dependencies"
+	"github.com/yyewolf/kaloupile/pkg/kind"
+	"github.com/yyewolf/kaloupile/pkg/pipeline"
+	"github.com/yyewolf/kaloupile/pkg/routes"
+)
+
+func newUpCommand(configPaths *[]string) *cobra.Command {
+	var (
+		force        bool
+		from         string
+		clusterFlags clusterFlags
+		waitFlags    waitFlags
+		syncFlags    syncFlags
+	)
+
+	cmd := &cobra.Command{
+		Use:   "up",
+		Short: "Run setup, dependencies, routes and sync as one pipeline",
+		Long: "Run setup, dependencies, routes and sync in dependency order.\n" +
+			"Steps whose inputs did not change since their last successful run are skipped,\n" +
+			"and a failed run resumes from the step that failed.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logStep("load config")
+			cfg, err := loadConfig(*configPaths)
+			if err != nil {
+				return err
+			}
+			if err := dependencies.Validate(cfg, dependencies.Enabled(cfg)); err != nil {
+				return err
+			}
+			logDone("load config")
+
+			p, err := newUpPipeline(cfg, &clusterFlags, &waitFlags, &syncFlags)
+			if err != nil {
+				return err
+			}
+
+			failed, err := p.FailedStep()
+			if err != nil {
+				return err
+			}
+			if failed != "" && !force && from == "" {
+				fmt.Printf("==> resuming from failed step %s\n", failed)
+			}
+
+			return p.Run(runStep, pipeline.Options{
+				Force: force,
+				From:  from,
+				OnSkip: func(name string) {
+					fmt.Printf("<== %s skipped (inputs unchanged)\n", name)
+				},
+			})
+		},
+	}
+
+	cmd.Flags().BoolVar(&force, "force", false, "Run every step even if its inputs are unchanged")
+	cmd.Flags().StringVar(&from, "from", "", "Force the given step and every step depending on it to run")
+	clusterFlags.register(cmd)
+	waitFlags.register(cmd)
+	syncFlags.register(cmd)
+
+	return cmd
+}
+
+func newUpPipeline(cfg *config.Config, clusterFlags *clusterFlags, waitFlags *waitFlags, syncFlags *syncFlags) (*pipeline.Pipeline, error) {
+	// The effective config is hashed rather than the files so overrides and
+	// resolved secrets are taken into account.
+	configHash, err := cfg.Fingerprint()
+	if err != nil {
+		return nil, err
+	}
+
+	// The cluster only depends on its kind config, so that other config
+	// changes do not rerun every step after it.
+	clusterConfig, err := kind.RenderClusterConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	steps := []pipeline.Step{
+		{
+			Name:        "ensure kind cluster",
+			Fingerprint: cfg.Cluster.Name + "\n" + string(clusterConfig),
+			Exists: func() (bool, error) {
+				return kind.ClusterExists(cfg)
+			},
+			Run: clusterFlags.ensureCluster(cfg),
+		},
+		{
+			Name:      "install prerequisites",
+			DependsOn: []string{"ensure kind cluster"},
+			Inputs:    []string{"cluster/prerequisites"},
+			Run:       waitFlags.installPrerequisites(cfg),
+		},
+	}
+
+	var installed []string
+	for _, dep := range dependencies.Enabled(cfg) {
+		fingerprint, err := dependencies.Fingerprint(cfg, dep)
+		if err != nil {
+			return nil, err
+		}
+
+		name := "install " + dep.Name()
+		installed = append(installed, name)
+		steps = append(steps, pipeline.Step{
+			Name:        name,
+			DependsOn:   []string{"install prerequisites"},
+			Fingerprint: fingerprint,
+			Run:         waitFlags.installDependency(cfg, dep),
+		})
+	}
+
+	steps = append(steps, pipeline.Step{
+		Name:        "install routes",
+		DependsOn:   append([]string{"install prerequisites"}, installed...),
+		Inputs:      []string{routes.RoutesTemplatePath},
+		Fingerprint: configHash,
+		Run: func() error {
+			return routes.InstallRoutes(cfg)
+		},
+	})
+
+	for _, target := range enabledSyncTargets(cfg) {
+		dependsOn := []string{"install routes"}
+		if target.after != "" {
+			dependsOn = []string{"sync " + target.after}
+		}
+		inputs := target.inputs
+		if target.configInputs != nil {
+			inputs = append(slices.Clone(inputs), target.configInputs(cfg)...)
+		}
+		steps = append(steps, pipeline.Step{
+			Name:        "sync " + target.name,
+			DependsOn:   dependsOn,
+			Inputs:      inputs,
+			Fingerprint: configHash,
+			Always:      target.always,
+			Run: func() error {
+				return target.run(cfg, syncFlags.options())
+			},
+		})
+	}
+
+	return pipeline.New(pipelineStatePath(cfg), steps...)
+}
+
+// pipelineStatePath keeps the pipeline state per cluster so parallel
+// environments do not share it.
+func pipelineStatePath(cfg *config.Config) string {
+	return filepath.Join(cfg.StateDir(), pipeline.StateFile)
+}
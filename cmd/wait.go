@@ -0,0 +1,39 @@
+package main
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"github.com/yyewolf/kaloupile/pkg/dependencies"
+	"github.com/yyewolf/kaloupile/pkg/kind"
+)
+
+type waitFlags struct {
+	timeout time.Duration
+}
+
+func (f *waitFlags) register(cmd *cobra.Command) {
+	cmd.Flags().DurationVar(&f.timeout, "wait-timeout", dependencies.DefaultWaitTimeout, "How long each install waits for readiness (0 disables waiting)")
+}
+
+// installPrerequisites installs the prerequisites and waits for the main
+// Gateway to be programmed.
+func (f *waitFlags) installPrerequisites(cfg *config.Config) func() error {
+	return func() error {
+		if err := kind.InstallPrerequisites(cfg); err != nil {
+			return err
+		}
+		return dependencies.WaitGateway(cfg, f.timeout)
+	}
+}
+
+// installDependency installs dep and waits for it to be ready.
+func (f *waitFlags) installDependency(cfg *config.Config, dep dependencies.Dependency) func() error {
+	return func() error {
+		if err := dep.Install(cfg); err != nil {
+			return err
+		}
+		return dependencies.WaitReady(cfg, dep, f.timeout)
+	}
+}
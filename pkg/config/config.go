@@ -1,65 +1,485 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"os"
+	"math/big"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	DefaultClusterName = "kaloupile-dev"
+	StateRootDir       = ".kaloupile"
+)
+
+// Config fields carry desc, default and enum tags; they feed the JSON Schema
+// served by Schema.
 type Config struct {
-	Scheme string `yaml:"scheme"`
-	Domain string `yaml:"domain"`
-	DNS    struct {
+	Scheme  string `yaml:"scheme" desc:"URL scheme the apps are served with" enum:"http,https" default:"http"`
+	Domain  string `yaml:"domain" desc:"Base domain of the dev environment, e.g. tristan.dev.uctf.io"`
+	Cluster struct {
+		Name string `yaml:"name" desc:"Name of the kind cluster; the kube context is kind-<name>" default:"kaloupile-dev"`
+		// HostPortOffset is added to every host port so several clusters can
+		// run side by side (e.g. 1000 maps 80 to 1080).
+		HostPortOffset int `yaml:"hostPortOffset" desc:"Added to every host port so several clusters can run side by side" default:"0"`
+		// Ports adds host port mappings or overrides the host port of the
+		// mappings declared by dependencies, matched on containerPort.
+		Ports []PortMapping `yaml:"ports" desc:"Extra host port mappings, or overrides of dependency mappings matched on containerPort"`
+		// Workers is the number of worker nodes next to the control plane.
+		Workers int `yaml:"workers" desc:"Number of worker nodes next to the control plane" default:"0"`
+		// NodeImage pins the kind node image, e.g. kindest/node:v1.33.1.
+		NodeImage string `yaml:"nodeImage" desc:"Kind node image, e.g. kindest/node:v1.33.1"`
+		// RegistryMirrors maps a registry host to the mirror endpoints
+		// containerd should try first, e.g. docker.io: [https://mirror.gcr.io].
+		RegistryMirrors map[string][]string `yaml:"registryMirrors" desc:"Mirror endpoints per registry host, e.g. docker.io: [https://mirror.gcr.io]"`
+	} `yaml:"cluster" desc:"Kind cluster settings"`
+	Dependencies map[string]DependencyConfig `yaml:"dependencies" desc:"Per dependency settings, keyed by dependency name (cert-manager, fake-smtp, postgresql, redis)"`
+	DNS          struct {
 		Infomaniak struct {
-			Token string `yaml:"token"`
-		} `yaml:"infomaniak"`
-	} `yaml:"dns"`
+			Token string `yaml:"token" secret:"true" desc:"Infomaniak API token used by the cert-manager DNS01 solver"`
+		} `yaml:"infomaniak" desc:"Infomaniak DNS settings"`
+	} `yaml:"dns" desc:"DNS settings"`
 	Postgres struct {
-		LocalHost string `yaml:"localHost"`
-		LocalPort int    `yaml:"localPort"`
-		Host      string `yaml:"host"`
-		Port      int    `yaml:"port"`
+		LocalHost string `yaml:"localHost" desc:"Host used to reach PostgreSQL from the host machine" default:"localhost"`
+		LocalPort int    `yaml:"localPort" desc:"Port used to reach PostgreSQL from the host machine; defaults to the mapped NodePort"`
+		Host      string `yaml:"host" desc:"PostgreSQL host inside the cluster"`
+		Port      int    `yaml:"port" desc:"PostgreSQL port inside the cluster"`
+		Admin     struct {
+			User     string `yaml:"user" desc:"Admin user"`
+			Password string `yaml:"password" secret:"true" desc:"Admin password"`
+			Database string `yaml:"database" desc:"Admin database"`
+		} `yaml:"admin" desc:"Admin credentials used to install and sync PostgreSQL"`
+		Image     string                     `yaml:"image" desc:"PostgreSQL image; its tag must start with the major version, and changing the major version dumps and restores every database on install" default:"mirror.gcr.io/postgres:16-alpine"`
+		Storage   string                     `yaml:"storage" desc:"Size of postgresql-pvc, only applied when the volume is created" default:"1Gi"`
+		Resources ResourceRequirements       `yaml:"resources" desc:"CPU and memory of the postgresql container; requests default to 250m and 256Mi, limits to 500m and 512Mi"`
+		Profiles  map[string]PostgresProfile `yaml:"profiles" desc:"Custom privilege profiles, keyed by the name used in postgres.users[].databases[].profile"`
+		Users     []PostgresUser             `yaml:"users" desc:"Users and databases reconciled by sync"`
+	} `yaml:"postgres" desc:"PostgreSQL settings"`
+	Redis struct {
+		LocalHost string `yaml:"localHost" desc:"Host used to reach Redis from the host machine" default:"localhost"`
+		LocalPort int    `yaml:"localPort" desc:"Port used to reach Redis from the host machine; defaults to the mapped NodePort"`
+		Host      string `yaml:"host" desc:"Redis host inside the cluster" default:"redis.external.svc.cluster.local"`
+		Port      int    `yaml:"port" desc:"Redis port inside the cluster" default:"6379"`
 		Admin     struct {
-			User     string `yaml:"user"`
-			Password string `yaml:"password"`
-			Database string `yaml:"database"`
-		} `yaml:"admin"`
-		Users []struct {
-			Name      string   `yaml:"name"`
-			Password  string   `yaml:"password"`
-			Databases []string `yaml:"databases"`
-		} `yaml:"users"`
-	} `yaml:"postgres"`
+			Password string `yaml:"password" secret:"true" desc:"Password of the default user"`
+		} `yaml:"admin" desc:"Credentials of the default user used to sync ACL users"`
+		Users []RedisUser `yaml:"users" desc:"ACL users reconciled by sync"`
+	} `yaml:"redis" desc:"Redis settings, used when the redis dependency is enabled"`
+	S3 struct {
+		Endpoint string `yaml:"endpoint" desc:"S3 endpoint reachable from the host; defaults to the host port mapped to the SeaweedFS NodePort"`
+		Region   string `yaml:"region" desc:"Region used to sign S3 requests" default:"us-east-1"`
+		Admin    struct {
+			AccessKey string `yaml:"accessKey" desc:"Access key of the admin identity used by sync and the S3 CSI driver"`
+			SecretKey string `yaml:"secretKey" secret:"true" desc:"Secret key of the admin identity"`
+		} `yaml:"admin" desc:"Admin identity of SeaweedFS S3"`
+		Buckets     []S3Bucket     `yaml:"buckets" desc:"Buckets created by sync when missing"`
+		Credentials []S3Credential `yaml:"credentials" desc:"Per service identities written to the SeaweedFS identities secret"`
+	} `yaml:"s3" desc:"SeaweedFS S3 buckets and credentials reconciled by sync"`
+	Services []Service `yaml:"services" desc:"Services developed against the cluster"`
+	Stripe   struct {
+		APIKey string `yaml:"apiKey" secret:"true" desc:"Stripe API key"`
+	} `yaml:"stripe" desc:"Stripe settings"`
+
+	files   []string
+	dir     string
+	source  *yaml.Node
+	origins map[*yaml.Node]string
+}
+
+type Service struct {
+	Name string `yaml:"name" desc:"Service name"`
+	Path string `yaml:"path" desc:"Path to the service checkout"`
+	// Extra keeps service specific keys; the Tiltfile hands the whole entry
+	// to the service's own Tiltfile entrypoint.
+	Extra map[string]any `yaml:"extra" desc:"Service specific settings, handed as is to the service Tiltfile"`
+}
+
+// ResourceRequirements mirrors the resources of a Kubernetes container.
+type ResourceRequirements struct {
+	Requests ResourceList `yaml:"requests" desc:"Resources reserved for the container"`
+	Limits   ResourceList `yaml:"limits" desc:"Resources the container may not exceed"`
+}
+
+type ResourceList struct {
+	CPU    string `yaml:"cpu" desc:"CPU quantity, e.g. 250m or 1"`
+	Memory string `yaml:"memory" desc:"Memory quantity, e.g. 256Mi or 1Gi"`
+}
+
+var quantityMultipliers = map[string]*big.Rat{
+	"":   big.NewRat(1, 1),
+	"m":  big.NewRat(1, 1000),
+	"k":  big.NewRat(1e3, 1),
+	"M":  big.NewRat(1e6, 1),
+	"G":  big.NewRat(1e9, 1),
+	"T":  big.NewRat(1e12, 1),
+	"Ki": big.NewRat(1<<10, 1),
+	"Mi": big.NewRat(1<<20, 1),
+	"Gi": big.NewRat(1<<30, 1),
+	"Ti": big.NewRat(1<<40, 1),
+}
+
+// ParseQuantity returns the value of a Kubernetes quantity such as 500m or
+// 1Gi, so that 1Gi and 1024Mi compare equal.
+func ParseQuantity(quantity string) (*big.Rat, error) {
+	match := quantityPattern.FindStringSubmatch(quantity)
+	if match == nil {
+		return nil, fmt.Errorf("%q is not a Kubernetes quantity such as 500m, 1 or 256Mi", quantity)
+	}
+	value, ok := new(big.Rat).SetString(match[1])
+	if !ok {
+		return nil, fmt.Errorf("%q is not a Kubernetes quantity such as 500m, 1 or 256Mi", quantity)
+	}
+	return value.Mul(value, quantityMultipliers[match[3]]), nil
+}
+
+// ImageMajorVersion reads the major version the tag of image starts with,
+// e.g. 16 for postgres:16-alpine or postgis/postgis:16-3.4.
+func ImageMajorVersion(image string) (int, bool) {
+	ref, _, _ := strings.Cut(image, "@")
+	i := strings.LastIndex(ref, ":")
+	if i < 0 || strings.Contains(ref[i:], "/") {
+		return 0, false
+	}
+	tag := ref[i+1:]
+	end := 0
+	for end < len(tag) && tag[end] >= '0' && tag[end] <= '9' {
+		end++
+	}
+	major, err := strconv.Atoi(tag[:end])
+	if err != nil {
+		return 0, false
+	}
+	return major, true
+}
+
+type PostgresUser struct {
+	Name     string `yaml:"name" desc:"Role name"`
+	Password string `yaml:"password" secret:"true" desc:"Role password"`
+	// Attributes not listed are reset, e.g. removing CREATEDB revokes it.
+	Attributes []string           `yaml:"attributes" desc:"Role attributes: CREATEDB, CREATEROLE, REPLICATION, BYPASSRLS or NOINHERIT"`
+	Databases  []PostgresDatabase `yaml:"databases" desc:"Databases the role gets access to, created when missing"`
+}
+
+type PostgresDatabase struct {
+	Name       string   `yaml:"name" desc:"Database name"`
+	Owner      string   `yaml:"owner" desc:"Role owning the database; left to the admin user when empty"`
+	Extensions []string `yaml:"extensions" desc:"Extensions created in the database, e.g. uuid-ossp, pgcrypto or postgis"`
+	Schemas    []string `yaml:"schemas" desc:"Schemas created in the database and granted to the user like public"`
+	Profile    string   `yaml:"profile" desc:"Privilege profile of the user on the database: owner, readwrite, readonly or a postgres.profiles name" default:"owner"`
+	Seed       string   `yaml:"seed" desc:"Directory of .sql files applied once each, in file name order, after the database is created"`
+}
+
+// PostgresProfile lists the privileges a user gets at each level. Privileges
+// granted beyond it are revoked by sync.
+type PostgresProfile struct {
+	Database  []string `yaml:"database" desc:"Database privileges: CREATE, CONNECT, TEMPORARY"`
+	Schema    []string `yaml:"schema" desc:"Privileges on public and the database schemas: USAGE, CREATE"`
+	Tables    []string `yaml:"tables" desc:"Privileges on existing and future tables: SELECT, INSERT, UPDATE, DELETE, TRUNCATE, REFERENCES, TRIGGER"`
+	Sequences []string `yaml:"sequences" desc:"Privileges on existing and future sequences: USAGE, SELECT, UPDATE"`
+}
+
+// Privileges a PostgresProfile may list at each level.
+var (
+	PostgresDatabasePrivileges = []string{"CREATE", "CONNECT", "TEMPORARY"}
+	PostgresSchemaPrivileges   = []string{"USAGE", "CREATE"}
+	// PostgresTablePrivileges leaves out MAINTAIN, which only exists from
+	// PostgreSQL 17 on.
+	PostgresTablePrivileges    = []string{"SELECT", "INSERT", "UPDATE", "DELETE", "TRUNCATE", "REFERENCES", "TRIGGER"}
+	PostgresSequencePrivileges = []string{"USAGE", "SELECT", "UPDATE"}
+)
+
+// PostgresBuiltinProfiles are the profiles available without declaring them
+// in postgres.profiles.
+var PostgresBuiltinProfiles = map[string]PostgresProfile{
+	"owner": {
+		Database:  PostgresDatabasePrivileges,
+		Schema:    PostgresSchemaPrivileges,
+		Tables:    PostgresTablePrivileges,
+		Sequences: PostgresSequencePrivileges,
+	},
+	"readwrite": {
+		Database:  []string{"CONNECT", "TEMPORARY"},
+		Schema:    []string{"USAGE"},
+		Tables:    []string{"SELECT", "INSERT", "UPDATE", "DELETE"},
+		Sequences: []string{"USAGE", "SELECT", "UPDATE"},
+	},
+	"readonly": {
+		Database:  []string{"CONNECT"},
+		Schema:    []string{"USAGE"},
+		Tables:    []string{"SELECT"},
+		Sequences: []string{"SELECT"},
+	},
+}
+
+// PostgresProfile resolves a profile name, built-in profiles first.
+func (c *Config) PostgresProfile(name string) (PostgresProfile, bool) {
+	if profile, ok := PostgresBuiltinProfiles[name]; ok {
+		return profile, true
+	}
+	profile, ok := c.Postgres.Profiles[name]
+	return profile, ok
+}
+
+// PostgresRoleAttributes are the attributes postgres.users[].attributes may
+// set; anything else, SUPERUSER included, is rejected.
+var PostgresRoleAttributes = []string{"CREATEDB", "CREATEROLE", "REPLICATION", "BYPASSRLS", "NOINHERIT"}
+
+type RedisUser struct {
+	Name        string   `yaml:"name" desc:"ACL user name"`
+	Password    string   `yaml:"password" secret:"true" desc:"ACL user password"`
+	KeyPrefixes []string `yaml:"keyPrefixes" desc:"Key and channel prefixes the user may access, e.g. basilic: grants ~basilic:*; defaults to <name>:"`
+	Commands    string   `yaml:"commands" desc:"ACL command rules, e.g. +@all -@dangerous" default:"+@all"`
+}
+
+type S3Bucket struct {
+	Name   string `yaml:"name" desc:"Bucket name"`
+	Access string `yaml:"access" desc:"Anonymous access to the bucket" enum:"private,public-read" default:"private"`
+}
+
+type S3Credential struct {
+	Name      string   `yaml:"name" desc:"Identity name, usually the service name"`
+	AccessKey string   `yaml:"accessKey" desc:"Access key of the identity"`
+	SecretKey string   `yaml:"secretKey" secret:"true" desc:"Secret key of the identity"`
+	Buckets   []string `yaml:"buckets" desc:"Buckets the identity may access"`
+	Access    string   `yaml:"access" desc:"Actions granted on the buckets" enum:"readwrite,readonly" default:"readwrite"`
+}
+
+type DependencyConfig struct {
+	Enabled *bool `yaml:"enabled" desc:"Whether the dependency is installed; most dependencies are enabled by default"`
+}
+
+type PortMapping struct {
+	Name          string `yaml:"name" desc:"Name of the mapping"`
+	ContainerPort int    `yaml:"containerPort" desc:"NodePort inside the cluster"`
+	HostPort      int    `yaml:"hostPort" desc:"Port on the host, before the offset"`
+	Protocol      string `yaml:"protocol" desc:"Protocol of the mapping" enum:"TCP,UDP,SCTP" default:"TCP"`
+}
+
+// GatewayPortMappings expose the gateway NodePorts installed with the
+// prerequisites on the host.
+var GatewayPortMappings = []PortMapping{
+	{Name: "http", ContainerPort: 30080, HostPort: 80, Protocol: "TCP"},
+	{Name: "https", ContainerPort: 30443, HostPort: 443, Protocol: "TCP"},
+}
+
+// S3NodePort is the NodePort of the SeaweedFS S3 API installed with the
+// prerequisites.
+const S3NodePort = 30833
+
+// S3PortMappings expose the SeaweedFS S3 API on the host so sync can reach it.
+var S3PortMappings = []PortMapping{
+	{Name: "s3", ContainerPort: S3NodePort, HostPort: 8333, Protocol: "TCP"},
 }
 
 func Load() (*Config, error) {
 	return LoadFromFile("config.yml")
 }
 
-func LoadFromFile(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
+// LoadFromFile loads path, deep-merged with its local override (e.g.
+// config.local.yml) and then with every override file in order. Later files
+// take precedence.
+func LoadFromFile(path string, overrides ...string) (*Config, error) {
+	paths, err := layerPaths(path, overrides)
 	if err != nil {
-		return nil, fmt.Errorf("read config %s: %w", path, err)
+		return nil, err
+	}
+
+	var merged *yaml.Node
+	origins := make(map[*yaml.Node]string)
+	for _, layerPath := range paths {
+		root, err := readLayer(layerPath)
+		if err != nil {
+			return nil, err
+		}
+		recordOrigins(root, layerPath, origins)
+		merged = mergeNodes(merged, root)
 	}
 
 	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	if merged != nil {
+		if err := merged.Decode(&cfg); err != nil {
+			return nil, fmt.Errorf("parse config %s: %w", strings.Join(paths, ", "), err)
+		}
 	}
+	cfg.files = paths
+	cfg.dir = filepath.Dir(path)
+	cfg.source = merged
+	cfg.origins = origins
+
+	if err := resolveReferences(&cfg, filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("config %s: %w", strings.Join(paths, ", "), err)
+	}
+
+	applyDefaults(&cfg)
 
 	return &cfg, nil
 }
 
-func ValidateDependencies(cfg *Config) error {
-	if cfg == nil {
-		return fmt.Errorf("config is nil")
+// Fingerprint hashes the effective config, resolved secrets included.
+func (c *Config) Fingerprint() (string, error) {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("encode config: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Files lists the config files that were merged, lowest precedence first.
+func (c *Config) Files() []string {
+	return append([]string(nil), c.files...)
+}
+
+func applyDefaults(cfg *Config) {
+	if cfg.Cluster.Name == "" {
+		cfg.Cluster.Name = DefaultClusterName
+	}
+	if cfg.Redis.LocalHost == "" {
+		cfg.Redis.LocalHost = "localhost"
+	}
+	if cfg.Redis.Host == "" {
+		cfg.Redis.Host = "redis.external.svc.cluster.local"
+	}
+	if cfg.Redis.Port == 0 {
+		cfg.Redis.Port = 6379
+	}
+	if cfg.Postgres.Image == "" {
+		cfg.Postgres.Image = "mirror.gcr.io/postgres:16-alpine"
+	}
+	if cfg.Postgres.Storage == "" {
+		cfg.Postgres.Storage = "1Gi"
+	}
+	for _, value := range []struct {
+		target   *string
+		fallback string
+	}{
+		{&cfg.Postgres.Resources.Requests.CPU, "250m"},
+		{&cfg.Postgres.Resources.Requests.Memory, "256Mi"},
+		{&cfg.Postgres.Resources.Limits.CPU, "500m"},
+		{&cfg.Postgres.Resources.Limits.Memory, "512Mi"},
+	} {
+		if *value.target == "" {
+			*value.target = value.fallback
+		}
+	}
+	for i := range cfg.Postgres.Users {
+		for j := range cfg.Postgres.Users[i].Databases {
+			if cfg.Postgres.Users[i].Databases[j].Profile == "" {
+				cfg.Postgres.Users[i].Databases[j].Profile = "owner"
+			}
+		}
+	}
+	for i := range cfg.Redis.Users {
+		if cfg.Redis.Users[i].Commands == "" {
+			cfg.Redis.Users[i].Commands = "+@all"
+		}
+	}
+	if cfg.S3.Region == "" {
+		cfg.S3.Region = "us-east-1"
+	}
+	for i := range cfg.S3.Buckets {
+		if cfg.S3.Buckets[i].Access == "" {
+			cfg.S3.Buckets[i].Access = "private"
+		}
+	}
+	for i := range cfg.S3.Credentials {
+		if cfg.S3.Credentials[i].Access == "" {
+			cfg.S3.Credentials[i].Access = "readwrite"
+		}
+	}
+	for i := range cfg.Cluster.Ports {
+		if cfg.Cluster.Ports[i].Protocol == "" {
+			cfg.Cluster.Ports[i].Protocol = "TCP"
+		}
+	}
+}
+
+// ResolvePorts merges the given default mappings with cluster.ports: entries
+// sharing a containerPort override the default, others are appended. The host
+// port offset is not applied.
+func (c *Config) ResolvePorts(defaults []PortMapping) []PortMapping {
+	resolved := append([]PortMapping(nil), defaults...)
+	for _, mapping := range c.Cluster.Ports {
+		overridden := false
+		for i := range resolved {
+			if resolved[i].ContainerPort == mapping.ContainerPort {
+				if mapping.Name == "" {
+					mapping.Name = resolved[i].Name
+				}
+				resolved[i] = mapping
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			resolved = append(resolved, mapping)
+		}
+	}
+	return resolved
+}
+
+// HostPort returns the host port, offset included, that the given node port
+// is mapped to, or 0 when it is not mapped.
+func (c *Config) HostPort(mappings []PortMapping, containerPort int) int {
+	for _, mapping := range mappings {
+		if mapping.ContainerPort == containerPort {
+			return mapping.HostPort + c.Cluster.HostPortOffset
+		}
 	}
+	return 0
+}
 
-	if strings.TrimSpace(cfg.DNS.Infomaniak.Token) == "" {
-		return fmt.Errorf("missing required config: dns.infomaniak.token")
+// DependencyEnabled reports whether the named dependency is explicitly
+// enabled or disabled; set is false when the config leaves it to the default.
+func (c *Config) DependencyEnabled(name string) (enabled, set bool) {
+	dep, ok := c.Dependencies[name]
+	if !ok || dep.Enabled == nil {
+		return false, false
 	}
+	return *dep.Enabled, true
+}
+
+// Service returns the service with the given name.
+func (c *Config) Service(name string) (Service, bool) {
+	for _, service := range c.Services {
+		if service.Name == name {
+			return service, true
+		}
+	}
+	return Service{}, false
+}
+
+// KubeContext is the kubeconfig context kind creates for the cluster.
+func (c *Config) KubeContext() string {
+	return "kind-" + c.Cluster.Name
+}
+
+// ResolvePath resolves a path from the config, such as a service path or a
+// seed directory, against the directory of the config file.
+func (c *Config) ResolvePath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(c.dir, path)
+}
+
+// PostgresDataMount is where the postgres image expects its volume. From 18
+// on, the official image keeps its data in a directory named after the major
+// version under /var/lib/postgresql, so pg_upgrade --link can work across
+// versions in one volume; older images use /var/lib/postgresql/data.
+func (c *Config) PostgresDataMount() string {
+	if major, ok := ImageMajorVersion(c.Postgres.Image); ok && major >= 18 {
+		return "/var/lib/postgresql"
+	}
+	return "/var/lib/postgresql/data"
+}
 
-	return nil
+// StateDir holds generated files and state for the configured cluster.
+func (c *Config) StateDir() string {
+	return filepath.Join(StateRootDir, c.Cluster.Name)
 }
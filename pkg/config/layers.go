@@ -0,0 +1,213 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LocalOverridePath returns the per-developer override file that sits next to
+// the given config file: config.yml -> config.local.yml.
+func LocalOverridePath(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + ".local" + ext
+}
+
+// layerPaths lists the files to merge, lowest precedence first: the base file,
+// its local override, then every explicit override in order. The base file
+// and its local override are optional as long as one file is loaded;
+// explicit overrides must exist.
+func layerPaths(base string, overrides []string) ([]string, error) {
+	var paths []string
+	seen := make(map[string]bool)
+	add := func(path string, required bool) error {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return fmt.Errorf("resolve config path %s: %w", path, err)
+		}
+		if seen[abs] {
+			return nil
+		}
+		if _, err := os.Stat(path); err != nil {
+			if !required && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return fmt.Errorf("read config %s: %w", path, err)
+		}
+		seen[abs] = true
+		paths = append(paths, path)
+		return nil
+	}
+
+	if err := add(base, len(overrides) == 0); err != nil {
+		return nil, err
+	}
+	if err := add(LocalOverridePath(base), false); err != nil {
+		return nil, err
+	}
+	for _, path := range overrides {
+		if err := add(path, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return paths, nil
+}
+
+// readLayer parses one config file. It is decoded strictly on its own first
+// so unknown keys are reported with the file they come from.
+func readLayer(path string) (*yaml.Node, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config %s: %w", path, err)
+	}
+
+	var strict Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&strict); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("parse config %s: top level must be a mapping", path)
+	}
+
+	return root, nil
+}
+
+// mergeNodes deep-merges src over dst. Mappings are merged key by key; any
+// other value, lists included, is replaced as a whole by the later layer.
+func mergeNodes(dst, src *yaml.Node) *yaml.Node {
+	if dst == nil {
+		return src
+	}
+	if src == nil {
+		return dst
+	}
+	if dst.Kind != yaml.MappingNode || src.Kind != yaml.MappingNode {
+		return src
+	}
+
+	merged := *dst
+	merged.Content = append([]*yaml.Node(nil), dst.Content...)
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+
+		found := false
+		for j := 0; j+1 < len(merged.Content); j += 2 {
+			if merged.Content[j].Value == key.Value {
+				// The later key wins so positions point at the override.
+				merged.Content[j] = key
+				merged.Content[j+1] = mergeNodes(merged.Content[j+1], value)
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged.Content = append(merged.Content, key, value)
+		}
+	}
+
+	return &merged
+}
+
+// recordOrigins remembers which file every node comes from, so positions in
+// the merged tree can be reported as file:line.
+func recordOrigins(node *yaml.Node, path string, origins map[*yaml.Node]string) {
+	if node == nil {
+		return
+	}
+	origins[node] = path
+	for _, child := range node.Content {
+		recordOrigins(child, path, origins)
+	}
+}
+
+// Position returns the file:line a config path such as postgres.users[0].name
+// was set at, or an empty string when it comes from a default.
+func (c *Config) Position(path string) string {
+	node := c.source
+	if node == nil || path == "" {
+		return ""
+	}
+
+	var last *yaml.Node
+	for _, segment := range strings.Split(path, ".") {
+		name, indexes := splitIndexes(segment)
+
+		if name != "" {
+			if node.Kind != yaml.MappingNode {
+				return c.positionOf(last)
+			}
+			found := false
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == name {
+					last = node.Content[i]
+					node = node.Content[i+1]
+					found = true
+					break
+				}
+			}
+			if !found {
+				return c.positionOf(last)
+			}
+		}
+
+		for _, index := range indexes {
+			if node.Kind != yaml.SequenceNode || index >= len(node.Content) {
+				return c.positionOf(last)
+			}
+			node = node.Content[index]
+			last = node
+		}
+	}
+
+	return c.positionOf(last)
+}
+
+func (c *Config) positionOf(node *yaml.Node) string {
+	if node == nil {
+		return ""
+	}
+	file, ok := c.origins[node]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", file, node.Line)
+}
+
+// splitIndexes splits "users[0]" into "users" and [0].
+func splitIndexes(segment string) (string, []int) {
+	name, rest, found := strings.Cut(segment, "[")
+	if !found {
+		return segment, nil
+	}
+
+	var indexes []int
+	for _, part := range strings.Split(rest, "[") {
+		index, err := strconv.Atoi(strings.TrimSuffix(part, "]"))
+		if err != nil {
+			return name, indexes
+		}
+		indexes = append(indexes, index)
+	}
+	return name, indexes
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	SchemaID  = "https://github.com/yyewolf/kaloupile/config.schema.json"
+	SchemaURL = "https://json-schema.org/draft/2020-12/schema"
+
+	secretDescription = " (supports ${env:VAR}, file:// and exec: references)"
+)
+
+// Schema returns the JSON Schema of config.yml, generated from the Config
+// struct tags. Every field must carry a desc tag so the schema cannot silently
+// lose documentation when fields are added.
+func Schema() ([]byte, error) {
+	root, err := schemaFor(reflect.TypeOf(Config{}), "")
+	if err != nil {
+		return nil, err
+	}
+	root["$schema"] = SchemaURL
+	root["$id"] = SchemaID
+	root["title"] = "kaloupile config"
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(root); err != nil {
+		return nil, fmt.Errorf("encode schema: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func schemaFor(t reflect.Type, path string) (map[string]any, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}, nil
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}, nil
+	case reflect.Interface:
+		return map[string]any{}, nil
+	case reflect.Pointer:
+		return schemaFor(t.Elem(), path)
+	case reflect.Slice:
+		items, err := schemaFor(t.Elem(), path+"[]")
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"type": "array", "items": items}, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("schema %s: map keys must be strings", path)
+		}
+		values, err := schemaFor(t.Elem(), path+".*")
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"type": "object", "additionalProperties": values}, nil
+	case reflect.Struct:
+		return structSchema(t, path)
+	}
+
+	return nil, fmt.Errorf("schema %s: unsupported type %s", path, t)
+}
+
+func structSchema(t reflect.Type, path string) (map[string]any, error) {
+	properties := make(map[string]any)
+	schema := map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		fieldPath := joinPath(path, name)
+		if options == "inline" {
+			// Inline fields swallow unknown keys, defeating the typo checks.
+			return nil, fmt.Errorf("schema %s: field %s.%s is inline, nest it under a key instead", fieldPath, t.Name(), field.Name)
+		}
+
+		property, err := schemaFor(field.Type, fieldPath)
+		if err != nil {
+			return nil, err
+		}
+
+		description := field.Tag.Get("desc")
+		if description == "" {
+			return nil, fmt.Errorf("schema %s: field %s.%s has no desc tag", fieldPath, t.Name(), field.Name)
+		}
+		if field.Tag.Get("secret") == "true" {
+			description += secretDescription
+		}
+		property["description"] = description
+
+		if enum := field.Tag.Get("enum"); enum != "" {
+			values := make([]any, 0)
+			for _, value := range strings.Split(enum, ",") {
+				values = append(values, value)
+			}
+			property["enum"] = values
+		}
+
+		if value, ok := field.Tag.Lookup("default"); ok {
+			typed, err := typedDefault(field.Type, value)
+			if err != nil {
+				return nil, fmt.Errorf("schema %s: %w", fieldPath, err)
+			}
+			property["default"] = typed
+		}
+
+		properties[name] = property
+	}
+
+	return schema, nil
+}
+
+func typedDefault(t reflect.Type, value string) (any, error) {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("default %q is not an integer", value)
+		}
+		return parsed, nil
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("default %q is not a boolean", value)
+		}
+		return parsed, nil
+	}
+	return value, nil
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSchemaMatchesCommittedFile(t *testing.T) {
+	schema, err := Schema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, err := os.ReadFile("../../config.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(schema, committed) {
+		t.Fatal("config.schema.json is out of date with config.Config, regenerate it with `go generate ./cmd`")
+	}
+}
+
+func TestSchemaRejectsUnknownServiceKeys(t *testing.T) {
+	data, err := Schema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Properties struct {
+			Services struct {
+				Items struct {
+					AdditionalProperties any                       `json:"additionalProperties"`
+					Properties           map[string]map[string]any `json:"properties"`
+				} `json:"items"`
+			} `json:"services"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	service := schema.Properties.Services.Items
+	if service.AdditionalProperties != false {
+		t.Fatalf("services items additionalProperties = %v, want false", service.AdditionalProperties)
+	}
+	if extra := service.Properties["extra"]; extra["type"] != "object" {
+		t.Fatalf("services items extra = %v, want an object", extra)
+	}
+}
+
+func TestLoadRejectsUnknownServiceKeys(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("services:\n  - name: basilic\n    pth: ../basilic\n")
+	if _, err := LoadFromFile(path); err == nil || !strings.Contains(err.Error(), "field pth not found") {
+		t.Fatalf("LoadFromFile with a pth typo = %v, want an unknown field error", err)
+	}
+
+	write("services:\n  - name: basilic\n    path: ../basilic\n    extra:\n      port: 8080\n")
+	cfg, err := LoadFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := cfg.Services[0].Extra["port"]; port != 8080 {
+		t.Fatalf("services[0].extra.port = %v, want 8080", port)
+	}
+}
@@ -0,0 +1,286 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	redactedValue = "[redacted]"
+	// minSecretLength keeps short values such as "dev" or "1" from being
+	// redacted everywhere they appear in unrelated output.
+	minSecretLength = 8
+)
+
+var (
+	envReferencePattern = regexp.MustCompile(`\$\{env:([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// resolveReferences replaces secret references in every string of the config:
+//
+//	${env:VAR}          value of the environment variable, may be embedded
+//	file:///path        content of the file (relative paths are resolved
+//	                    against the config file directory)
+//	exec:command args   stdout of the command, run through sh -c
+//
+// Resolved values are registered for redaction and never included in errors,
+// unless they are shorter than minSecretLength or also written in clear
+// elsewhere in the config, e.g. a password equal to a user name.
+func resolveReferences(cfg *Config, baseDir string) error {
+	plain := make(map[string]bool)
+	if err := resolveValue(reflect.ValueOf(cfg).Elem(), "", baseDir, plain); err != nil {
+		return err
+	}
+	forgetSecrets(plain)
+	return nil
+}
+
+func resolveValue(v reflect.Value, path, baseDir string, plain map[string]bool) error {
+	switch v.Kind() {
+	case reflect.String:
+		resolved, changed, err := resolveString(v.String(), baseDir)
+		if err != nil {
+			return fmt.Errorf("resolve %s: %w", path, err)
+		}
+		if changed {
+			v.SetString(resolved)
+		} else {
+			plain[resolved] = true
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if err := resolveValue(v.Field(i), joinPath(path, yamlName(field)), baseDir, plain); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := resolveValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), baseDir, plain); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			if err := resolveValue(elem, joinPath(path, fmt.Sprint(key.Interface())), baseDir, plain); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		elem := reflect.New(v.Elem().Type()).Elem()
+		elem.Set(v.Elem())
+		if err := resolveValue(elem, path, baseDir, plain); err != nil {
+			return err
+		}
+		v.Set(elem)
+	}
+
+	return nil
+}
+
+func resolveString(value, baseDir string) (string, bool, error) {
+	switch {
+	case strings.HasPrefix(value, "file://"):
+		secret, err := readFileReference(strings.TrimPrefix(value, "file://"), baseDir)
+		if err != nil {
+			return "", false, err
+		}
+		registerSecret(secret)
+		return secret, true, nil
+	case strings.HasPrefix(value, "exec:"):
+		secret, err := runExecReference(strings.TrimSpace(strings.TrimPrefix(value, "exec:")), baseDir)
+		if err != nil {
+			return "", false, err
+		}
+		registerSecret(secret)
+		return secret, true, nil
+	case envReferencePattern.MatchString(value):
+		var missing []string
+		resolved := envReferencePattern.ReplaceAllStringFunc(value, func(match string) string {
+			name := envReferencePattern.FindStringSubmatch(match)[1]
+			secret, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+				return ""
+			}
+			registerSecret(secret)
+			return secret
+		})
+		if len(missing) > 0 {
+			return "", false, fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+		}
+		return resolved, true, nil
+	}
+
+	return value, false, nil
+}
+
+func readFileReference(path, baseDir string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("file reference has no path")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(baseDir, path)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read secret file %s: %w", path, err)
+	}
+
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+func runExecReference(command, baseDir string) (string, error) {
+	if command == "" {
+		return "", fmt.Errorf("exec reference has no command")
+	}
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Dir = baseDir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// stdout may hold part of the secret, only stderr is reported.
+		return "", fmt.Errorf("exec %q failed: %w: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimRight(stdout.String(), "\r\n"), nil
+}
+
+func registerSecret(value string) {
+	if len(strings.TrimSpace(value)) < minSecretLength {
+		return
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, existing := range secrets {
+		if existing == value {
+			return
+		}
+	}
+	secrets = append(secrets, value)
+	// Longest first so a secret containing another one is fully redacted.
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+}
+
+func forgetSecrets(plain map[string]bool) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secrets = slices.DeleteFunc(secrets, func(secret string) bool { return plain[secret] })
+}
+
+// Redact replaces every secret resolved from a reference with a placeholder.
+// Command runners pass their output and errors through it before logging.
+func Redact(input string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for _, secret := range secrets {
+		input = strings.ReplaceAll(input, secret, redactedValue)
+	}
+	return input
+}
+
+// Redacted returns a copy of the config where fields tagged secret and every
+// resolved secret reference are masked, for display.
+func (c *Config) Redacted() (*Config, error) {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("copy config: %w", err)
+	}
+
+	var copied Config
+	if err := yaml.Unmarshal(data, &copied); err != nil {
+		return nil, fmt.Errorf("copy config: %w", err)
+	}
+	copied.files = c.Files()
+
+	redactValue(reflect.ValueOf(&copied).Elem(), false)
+	return &copied, nil
+}
+
+func redactValue(v reflect.Value, secret bool) {
+	switch v.Kind() {
+	case reflect.String:
+		if secret && v.String() != "" {
+			v.SetString(redactedValue)
+		} else {
+			v.SetString(Redact(v.String()))
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			redactValue(v.Field(i), secret || field.Tag.Get("secret") == "true")
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			redactValue(v.Index(i), secret)
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			redactValue(elem, secret)
+			v.SetMapIndex(key, elem)
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		elem := reflect.New(v.Elem().Type()).Elem()
+		elem.Set(v.Elem())
+		redactValue(elem, secret)
+		v.Set(elem)
+	}
+}
+
+func yamlName(field reflect.StructField) string {
+	name, options, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "" && options == "inline" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+func joinPath(parent, child string) string {
+	if parent == "" {
+		return child
+	}
+	if child == "" {
+		return parent
+	}
+	return parent + "." + child
+}
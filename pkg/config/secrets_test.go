@@ -0,0 +1,39 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRedactSkipsShortAndClearValues(t *testing.T) {
+	t.Setenv("KALOUPILE_TEST_SHORT", "dev")
+	t.Setenv("KALOUPILE_TEST_USER", "kaloupile")
+	t.Setenv("KALOUPILE_TEST_TOKEN", "sk_test_4eC39HqLyjWDarjtT1zdp7dc")
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	content := `postgres:
+  admin:
+    user: kaloupile
+    password: ${env:KALOUPILE_TEST_USER}
+    database: ${env:KALOUPILE_TEST_SHORT}
+stripe:
+  apiKey: ${env:KALOUPILE_TEST_TOKEN}
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for input, want := range map[string]string{
+		"deploy to dev":                               "deploy to dev",
+		"role kaloupile created":                      "role kaloupile created",
+		"token sk_test_4eC39HqLyjWDarjtT1zdp7dc used": "token [redacted] used",
+	} {
+		if got := Redact(input); got != want {
+			t.Errorf("Redact(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
@@ -0,0 +1,533 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	minNodePort = 30000
+	maxNodePort = 32767
+	maxPort     = 65535
+	// maxIdentifierLength is PostgreSQL's NAMEDATALEN - 1.
+	maxIdentifierLength = 63
+)
+
+var (
+	dnsLabelPattern           = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+	postgresIdentifierPattern = regexp.MustCompile(`^[a-z_][a-z0-9_$]*$`)
+	redisNamePattern          = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+	extensionNamePattern      = regexp.MustCompile(`^[a-z0-9_][a-z0-9_-]*$`)
+	bucketNamePattern         = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+	quantityPattern           = regexp.MustCompile(`^([0-9]+(\.[0-9]+)?|\.[0-9]+)(m|k|Ki|M|Mi|G|Gi|T|Ti)?$`)
+)
+
+var (
+	dependencyNamesMu sync.RWMutex
+	dependencyNames   []string
+)
+
+// RegisterDependency makes name a valid key of dependencies. The
+// dependencies package registers every dependency it knows; until one is
+// registered, any name is accepted.
+func RegisterDependency(name string) {
+	dependencyNamesMu.Lock()
+	defer dependencyNamesMu.Unlock()
+
+	dependencyNames = append(dependencyNames, name)
+	sort.Strings(dependencyNames)
+}
+
+type Problem struct {
+	Path     string
+	Position string
+	Message  string
+}
+
+func (p Problem) String() string {
+	if p.Position != "" {
+		return fmt.Sprintf("%s: %s: %s", p.Position, p.Path, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+// ValidationError aggregates every problem found in the config.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, 0, len(e.Problems)+1)
+	lines = append(lines, fmt.Sprintf("invalid config (%d problems):", len(e.Problems)))
+	for _, problem := range e.Problems {
+		lines = append(lines, "  - "+problem.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+type validator struct {
+	cfg      *Config
+	problems []Problem
+}
+
+func (v *validator) add(path, format string, args ...any) {
+	v.problems = append(v.problems, Problem{
+		Path:     path,
+		Position: v.cfg.Position(path),
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Validate checks the whole config and returns a *ValidationError listing
+// every problem at once.
+func Validate(cfg *Config) error {
+	if cfg == nil {
+		return fmt.Errorf("config is nil")
+	}
+
+	v := &validator{cfg: cfg}
+	v.validateDomain()
+	v.validateCluster()
+	v.validatePostgres()
+	v.validateRedis()
+	v.validateS3()
+	v.validateServices()
+	v.validateDependencies()
+
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: v.problems}
+}
+
+func (v *validator) validateDomain() {
+	switch v.cfg.Scheme {
+	case "http", "https":
+	case "":
+		v.add("scheme", "is required (http or https)")
+	default:
+		v.add("scheme", "must be http or https, got %q", v.cfg.Scheme)
+	}
+
+	domain := v.cfg.Domain
+	if domain == "" {
+		v.add("domain", "is required")
+		return
+	}
+	if len(domain) > 253 {
+		v.add("domain", "must be at most 253 characters")
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) > 63 || !dnsLabelPattern.MatchString(label) {
+			v.add("domain", "%q is not a valid DNS name (lowercase letters, digits and '-', labels of 1 to 63 characters)", domain)
+			return
+		}
+	}
+}
+
+func (v *validator) validateCluster() {
+	cluster := v.cfg.Cluster
+	if !dnsLabelPattern.MatchString(cluster.Name) || len(cluster.Name) > 63 {
+		v.add("cluster.name", "%q must be a lowercase DNS label", cluster.Name)
+	}
+	if cluster.HostPortOffset < 0 {
+		v.add("cluster.hostPortOffset", "must not be negative")
+	}
+	if cluster.Workers < 0 {
+		v.add("cluster.workers", "must not be negative")
+	}
+
+	for i, mapping := range cluster.Ports {
+		path := fmt.Sprintf("cluster.ports[%d]", i)
+		if mapping.ContainerPort < minNodePort || mapping.ContainerPort > maxNodePort {
+			v.add(path+".containerPort", "must be a NodePort between %d and %d, got %d", minNodePort, maxNodePort, mapping.ContainerPort)
+		}
+		if hostPort := mapping.HostPort + cluster.HostPortOffset; hostPort < 1 || hostPort > maxPort {
+			v.add(path+".hostPort", "must be between 1 and %d once offset, got %d", maxPort, hostPort)
+		}
+		switch mapping.Protocol {
+		case "TCP", "UDP", "SCTP":
+		default:
+			v.add(path+".protocol", "must be TCP, UDP or SCTP, got %q", mapping.Protocol)
+		}
+	}
+}
+
+func (v *validator) validatePostgres() {
+	pg := v.cfg.Postgres
+	// The connection settings are only needed when PostgreSQL is installed,
+	// which it is unless disabled.
+	enabled, set := v.cfg.DependencyEnabled("postgresql")
+	required := enabled || !set
+
+	v.validatePort("postgres.port", pg.Port, required)
+	v.validatePort("postgres.localPort", pg.LocalPort, false)
+	if pg.Host == "" && required {
+		v.add("postgres.host", "is required")
+	}
+
+	if pg.Admin.User != "" {
+		v.validateIdentifier("postgres.admin.user", pg.Admin.User)
+	} else if required {
+		v.add("postgres.admin.user", "is required")
+	}
+	if pg.Admin.Password == "" && required {
+		v.add("postgres.admin.password", "is required")
+	}
+	if pg.Admin.Database != "" {
+		v.validateIdentifier("postgres.admin.database", pg.Admin.Database)
+	} else if required {
+		v.add("postgres.admin.database", "is required")
+	}
+
+	if _, ok := ImageMajorVersion(pg.Image); !ok {
+		v.add("postgres.image", "%q must have a tag starting with the PostgreSQL major version, e.g. postgres:17-alpine", pg.Image)
+	}
+	v.validateQuantity("postgres.storage", pg.Storage)
+	v.validateQuantity("postgres.resources.requests.cpu", pg.Resources.Requests.CPU)
+	v.validateQuantity("postgres.resources.requests.memory", pg.Resources.Requests.Memory)
+	v.validateQuantity("postgres.resources.limits.cpu", pg.Resources.Limits.CPU)
+	v.validateQuantity("postgres.resources.limits.memory", pg.Resources.Limits.Memory)
+
+	v.validatePostgresProfiles()
+
+	seen := make(map[string]int)
+	for i, user := range pg.Users {
+		path := fmt.Sprintf("postgres.users[%d]", i)
+		if user.Name == "" {
+			v.add(path+".name", "is required")
+		} else {
+			v.validateIdentifier(path+".name", user.Name)
+			if first, ok := seen[user.Name]; ok {
+				v.add(path+".name", "duplicates postgres.users[%d].name %q", first, user.Name)
+			} else {
+				seen[user.Name] = i
+			}
+			if user.Name == pg.Admin.User {
+				v.add(path+".name", "must not be the admin user %q", user.Name)
+			}
+		}
+		if user.Password == "" {
+			v.add(path+".password", "is required")
+		}
+
+		for j, attribute := range user.Attributes {
+			if !slices.Contains(PostgresRoleAttributes, attribute) {
+				v.add(fmt.Sprintf("%s.attributes[%d]", path, j), "must be one of %s, got %q", strings.Join(PostgresRoleAttributes, ", "), attribute)
+			}
+		}
+
+		for j, database := range user.Databases {
+			dbPath := fmt.Sprintf("%s.databases[%d]", path, j)
+			v.validateIdentifier(dbPath+".name", database.Name)
+			for k, extension := range database.Extensions {
+				if !extensionNamePattern.MatchString(extension) {
+					v.add(fmt.Sprintf("%s.extensions[%d]", dbPath, k), "%q is not a valid extension name", extension)
+				}
+			}
+			for k, schema := range database.Schemas {
+				v.validateIdentifier(fmt.Sprintf("%s.schemas[%d]", dbPath, k), schema)
+			}
+			if _, ok := v.cfg.PostgresProfile(database.Profile); !ok {
+				v.add(dbPath+".profile", "%q must be owner, readwrite, readonly or one of postgres.profiles", database.Profile)
+			}
+			if database.Seed != "" {
+				info, err := os.Stat(v.cfg.ResolvePath(database.Seed))
+				switch {
+				case err != nil:
+					v.add(dbPath+".seed", "%s does not exist", database.Seed)
+				case !info.IsDir():
+					v.add(dbPath+".seed", "%s is not a directory", database.Seed)
+				}
+			}
+		}
+	}
+
+	v.validateDatabaseOwners(seen)
+	v.validateDatabaseSeeds()
+}
+
+func (v *validator) validatePostgresProfiles() {
+	names := make([]string, 0, len(v.cfg.Postgres.Profiles))
+	for name := range v.cfg.Postgres.Profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		profile := v.cfg.Postgres.Profiles[name]
+		path := "postgres.profiles." + name
+		if _, ok := PostgresBuiltinProfiles[name]; ok {
+			v.add(path, "must not redefine the built-in profile %q", name)
+		}
+		for _, level := range []struct {
+			key        string
+			privileges []string
+			allowed    []string
+		}{
+			{"database", profile.Database, PostgresDatabasePrivileges},
+			{"schema", profile.Schema, PostgresSchemaPrivileges},
+			{"tables", profile.Tables, PostgresTablePrivileges},
+			{"sequences", profile.Sequences, PostgresSequencePrivileges},
+		} {
+			for i, privilege := range level.privileges {
+				if !slices.Contains(level.allowed, privilege) {
+					v.add(fmt.Sprintf("%s.%s[%d]", path, level.key, i), "must be one of %s, got %q", strings.Join(level.allowed, ", "), privilege)
+				}
+			}
+		}
+	}
+}
+
+// validateDatabaseOwners checks that owners are known roles and that a
+// database listed under several users does not get conflicting owners.
+func (v *validator) validateDatabaseOwners(users map[string]int) {
+	pg := v.cfg.Postgres
+	owners := make(map[string]string)
+	for i, user := range pg.Users {
+		for j, database := range user.Databases {
+			if database.Owner == "" {
+				continue
+			}
+			path := fmt.Sprintf("postgres.users[%d].databases[%d].owner", i, j)
+			if _, ok := users[database.Owner]; !ok && database.Owner != pg.Admin.User {
+				v.add(path, "%q must be the admin user or one of postgres.users", database.Owner)
+				continue
+			}
+			if owner, ok := owners[database.Name]; ok && owner != database.Owner {
+				v.add(path, "%q conflicts with owner %q set for database %q elsewhere", database.Owner, owner, database.Name)
+				continue
+			}
+			owners[database.Name] = database.Owner
+		}
+	}
+}
+
+// validateDatabaseSeeds checks that a database listed under several users is
+// seeded from one directory at most.
+func (v *validator) validateDatabaseSeeds() {
+	seeds := make(map[string]string)
+	for i, user := range v.cfg.Postgres.Users {
+		for j, database := range user.Databases {
+			if database.Seed == "" {
+				continue
+			}
+			if seed, ok := seeds[database.Name]; ok && seed != database.Seed {
+				v.add(fmt.Sprintf("postgres.users[%d].databases[%d].seed", i, j), "%q conflicts with seed %q set for database %q elsewhere", database.Seed, seed, database.Name)
+				continue
+			}
+			seeds[database.Name] = database.Seed
+		}
+	}
+}
+
+func (v *validator) validateRedis() {
+	redis := v.cfg.Redis
+
+	v.validatePort("redis.port", redis.Port, true)
+	v.validatePort("redis.localPort", redis.LocalPort, false)
+
+	seen := make(map[string]int)
+	for i, user := range redis.Users {
+		path := fmt.Sprintf("redis.users[%d]", i)
+		switch {
+		case user.Name == "":
+			v.add(path+".name", "is required")
+		case !redisNamePattern.MatchString(user.Name):
+			v.add(path+".name", "%q must contain only letters, digits, '_', '-', '.' or ':'", user.Name)
+		case user.Name == "default":
+			v.add(path+".name", "must not be the default user")
+		default:
+			if first, ok := seen[user.Name]; ok {
+				v.add(path+".name", "duplicates redis.users[%d].name %q", first, user.Name)
+			} else {
+				seen[user.Name] = i
+			}
+		}
+		if user.Password == "" {
+			v.add(path+".password", "is required")
+		}
+		for j, prefix := range user.KeyPrefixes {
+			if prefix == "" || strings.ContainsAny(prefix, " \t*?[") {
+				v.add(fmt.Sprintf("%s.keyPrefixes[%d]", path, j), "%q must be a non-empty literal prefix without spaces or glob characters", prefix)
+			}
+		}
+	}
+}
+
+func (v *validator) validateS3() {
+	s3 := v.cfg.S3
+
+	if s3.Endpoint != "" {
+		if u, err := url.Parse(s3.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add("s3.endpoint", "%q must be an http or https URL", s3.Endpoint)
+		}
+	}
+	if len(s3.Buckets) > 0 || len(s3.Credentials) > 0 {
+		if s3.Admin.AccessKey == "" {
+			v.add("s3.admin.accessKey", "is required when buckets or credentials are configured")
+		}
+		if s3.Admin.SecretKey == "" {
+			v.add("s3.admin.secretKey", "is required when buckets or credentials are configured")
+		}
+	}
+
+	buckets := make(map[string]int)
+	for i, bucket := range s3.Buckets {
+		path := fmt.Sprintf("s3.buckets[%d]", i)
+		switch {
+		case !bucketNamePattern.MatchString(bucket.Name):
+			v.add(path+".name", "%q must be 3 to 63 lowercase letters, digits, '.' or '-', starting and ending with a letter or digit", bucket.Name)
+		default:
+			if first, ok := buckets[bucket.Name]; ok {
+				v.add(path+".name", "duplicates s3.buckets[%d].name %q", first, bucket.Name)
+			} else {
+				buckets[bucket.Name] = i
+			}
+		}
+		switch bucket.Access {
+		case "private", "public-read":
+		default:
+			v.add(path+".access", "must be private or public-read, got %q", bucket.Access)
+		}
+	}
+
+	names := make(map[string]int)
+	accessKeys := map[string]string{s3.Admin.AccessKey: "s3.admin.accessKey"}
+	for i, credential := range s3.Credentials {
+		path := fmt.Sprintf("s3.credentials[%d]", i)
+		switch {
+		case credential.Name == "":
+			v.add(path+".name", "is required")
+		case credential.Name == "anonymous":
+			v.add(path+".name", "must not be anonymous, use a public-read bucket instead")
+		default:
+			if first, ok := names[credential.Name]; ok {
+				v.add(path+".name", "duplicates s3.credentials[%d].name %q", first, credential.Name)
+			} else {
+				names[credential.Name] = i
+			}
+		}
+		if credential.AccessKey == "" {
+			v.add(path+".accessKey", "is required")
+		} else if other, ok := accessKeys[credential.AccessKey]; ok {
+			v.add(path+".accessKey", "duplicates %s", other)
+		} else {
+			accessKeys[credential.AccessKey] = path + ".accessKey"
+		}
+		if credential.SecretKey == "" {
+			v.add(path+".secretKey", "is required")
+		}
+		if len(credential.Buckets) == 0 {
+			v.add(path+".buckets", "must list at least one bucket")
+		}
+		for j, bucket := range credential.Buckets {
+			if _, ok := buckets[bucket]; !ok {
+				v.add(fmt.Sprintf("%s.buckets[%d]", path, j), "%q is not declared in s3.buckets", bucket)
+			}
+		}
+		switch credential.Access {
+		case "readwrite", "readonly":
+		default:
+			v.add(path+".access", "must be readwrite or readonly, got %q", credential.Access)
+		}
+	}
+}
+
+func (v *validator) validateServices() {
+	seen := make(map[string]int)
+	for i, service := range v.cfg.Services {
+		path := fmt.Sprintf("services[%d]", i)
+		if service.Name == "" {
+			v.add(path+".name", "is required")
+		} else if first, ok := seen[service.Name]; ok {
+			v.add(path+".name", "duplicates services[%d].name %q", first, service.Name)
+		} else {
+			seen[service.Name] = i
+		}
+
+		if service.Path == "" {
+			v.add(path+".path", "is required")
+		}
+	}
+}
+
+func (v *validator) validateDependencies() {
+	dependencyNamesMu.RLock()
+	known := slices.Clone(dependencyNames)
+	dependencyNamesMu.RUnlock()
+	if len(known) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(v.cfg.Dependencies))
+	for name := range v.cfg.Dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !slices.Contains(known, name) {
+			v.add("dependencies."+name, "unknown dependency (known: %s)", strings.Join(known, ", "))
+		}
+	}
+}
+
+// Warnings lists what is worth reporting in the config without making it
+// invalid: a service checked out later only misses its mount until then.
+func Warnings(cfg *Config) []Problem {
+	if cfg == nil {
+		return nil
+	}
+
+	v := &validator{cfg: cfg}
+	for i, service := range cfg.Services {
+		if service.Path == "" {
+			continue
+		}
+		path := fmt.Sprintf("services[%d].path", i)
+		info, err := os.Stat(cfg.ResolvePath(service.Path))
+		switch {
+		case err != nil:
+			v.add(path, "%s does not exist, the service is not mounted", service.Path)
+		case !info.IsDir():
+			v.add(path, "%s is not a directory, the service is not mounted", service.Path)
+		}
+	}
+	return v.problems
+}
+
+func (v *validator) validateQuantity(path, quantity string) {
+	if _, err := ParseQuantity(quantity); err != nil {
+		v.add(path, "%s", err)
+	}
+}
+
+func (v *validator) validatePort(path string, port int, required bool) {
+	if port == 0 && !required {
+		return
+	}
+	if port < 1 || port > maxPort {
+		v.add(path, "must be between 1 and %d, got %d", maxPort, port)
+	}
+}
+
+// validateIdentifier enforces unquoted PostgreSQL identifier rules, lowercase
+// included, so names behave the same whether or not a client quotes them.
+func (v *validator) validateIdentifier(path, name string) {
+	if name == "" {
+		v.add(path, "must not be empty")
+		return
+	}
+	if len(name) > maxIdentifierLength {
+		v.add(path, "%q is longer than %d bytes", name, maxIdentifierLength)
+	}
+	if !postgresIdentifierPattern.MatchString(name) {
+		v.add(path, "%q must start with a lowercase letter or '_' and contain only lowercase letters, digits, '_' or '$'", name)
+	}
+}
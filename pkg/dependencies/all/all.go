@@ -0,0 +1,10 @@
+// Package all registers every dependency. Adding a backing service means
+// adding its package and importing it here.
+package all
+
+import (
+	_ "github.com/yyewolf/kaloupile/pkg/dependencies/certmanager"
+	_ "github.com/yyewolf/kaloupile/pkg/dependencies/fakesmtp"
+	_ "github.com/yyewolf/kaloupile/pkg/dependencies/postgresql"
+	_ "github.com/yyewolf/kaloupile/pkg/dependencies/redis"
+)
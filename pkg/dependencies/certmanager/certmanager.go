@@ -0,0 +1,109 @@
+package certmanager
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"github.com/yyewolf/kaloupile/pkg/dependencies"
+)
+
+const (
+	Name                          = "cert-manager"
+	InfomaniakCredentialsTemplate = "cluster/dependencies/cert-manager/infomaniak-api-credentials.yaml"
+	CertificateTemplate           = "cluster/dependencies/cert-manager/certificate.yaml"
+	CertificateName               = "main-certificate"
+	CertificateNamespace          = "gateway"
+)
+
+func init() {
+	dependencies.Register(&Dependency{
+		Templates: []string{InfomaniakCredentialsTemplate, CertificateTemplate},
+	})
+}
+
+// Dependency installs the Infomaniak API credentials, the ClusterIssuer and
+// the wildcard Certificate on top of cert-manager from the prerequisites.
+type Dependency struct {
+	Templates []string
+}
+
+func (d *Dependency) Name() string {
+	return Name
+}
+
+func (d *Dependency) Validate(cfg *config.Config) error {
+	if strings.TrimSpace(cfg.DNS.Infomaniak.Token) == "" {
+		return fmt.Errorf("missing required config: dns.infomaniak.token")
+	}
+	return nil
+}
+
+func (d *Dependency) Render(cfg *config.Config) ([]byte, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+
+	var manifests [][]byte
+	for _, templatePath := range d.Templates {
+		rendered, err := dependencies.RenderTemplate(templatePath, cfg)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, bytes.TrimSpace(rendered))
+	}
+
+	return append(bytes.Join(manifests, []byte("\n---\n")), '\n'), nil
+}
+
+func (d *Dependency) Install(cfg *config.Config) error {
+	if cfg == nil {
+		return fmt.Errorf("config is nil")
+	}
+	if err := d.Validate(cfg); err != nil {
+		return err
+	}
+	if err := dependencies.RequireKubectl(); err != nil {
+		return err
+	}
+
+	rendered, err := d.Render(cfg)
+	if err != nil {
+		return err
+	}
+	return dependencies.ApplyManifest(cfg.KubeContext(), rendered)
+}
+
+func (d *Dependency) Ready(cfg *config.Config) (bool, string, error) {
+	if cfg == nil {
+		return false, "", fmt.Errorf("config is nil")
+	}
+	return dependencies.ConditionTrue(cfg.KubeContext(), "certificate", CertificateNamespace, CertificateName, "Ready")
+}
+
+func (d *Dependency) Resources(cfg *config.Config) []dependencies.Resource {
+	return []dependencies.Resource{
+		{Kind: "Certificate", Namespace: CertificateNamespace, Name: CertificateName},
+		{Kind: "Deployment", Namespace: "cert-manager", Name: "cert-manager"},
+	}
+}
+
+func (d *Dependency) Uninstall(cfg *config.Config) error {
+	rendered, err := d.Render(cfg)
+	if err != nil {
+		return err
+	}
+	if err := dependencies.RequireKubectl(); err != nil {
+		return err
+	}
+	return dependencies.DeleteManifest(cfg.KubeContext(), rendered)
+}
+
+func (d *Dependency) ConfigHash(cfg *config.Config) (string, error) {
+	rendered, err := d.Render(cfg)
+	if err != nil {
+		return "", err
+	}
+	return dependencies.HashManifest(rendered), nil
+}
@@ -0,0 +1,192 @@
+package dependencies
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/yyewolf/kaloupile/pkg/config"
+)
+
+// Namespace is where backing services are installed.
+const Namespace = "external"
+
+// Dependency is a backing service installed into the cluster. Implementations
+// live in their own package and call Register from init; the all package
+// imports every one of them.
+type Dependency interface {
+	Name() string
+	// Render returns the manifest the dependency applies.
+	Render(cfg *config.Config) ([]byte, error)
+	Install(cfg *config.Config) error
+	// Ready reports whether the dependency is serving, with a short detail.
+	Ready(cfg *config.Config) (bool, string, error)
+	Uninstall(cfg *config.Config) error
+	// ConfigHash changes whenever the installed dependency must change.
+	ConfigHash(cfg *config.Config) (string, error)
+}
+
+// Validator is implemented by dependencies that need config beyond what
+// config.Validate checks, e.g. credentials only they use.
+type Validator interface {
+	Validate(cfg *config.Config) error
+}
+
+// Optional is implemented by dependencies that are only installed when the
+// config enables them explicitly.
+type Optional interface {
+	EnabledByDefault() bool
+}
+
+// DataResetter is implemented by dependencies keeping data that Install never
+// deletes; ResetData wipes it so that the next Install starts from scratch.
+type DataResetter interface {
+	ResetData(cfg *config.Config) error
+}
+
+// PortMapper is implemented by dependencies exposing NodePorts on the host.
+type PortMapper interface {
+	PortMappings() []config.PortMapping
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Dependency)
+)
+
+func Register(dep Dependency) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	name := dep.Name()
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("dependency %s registered twice", name))
+	}
+	registry[name] = dep
+	config.RegisterDependency(name)
+}
+
+// All returns every registered dependency sorted by name.
+func All() []Dependency {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	deps := make([]Dependency, 0, len(registry))
+	for _, dep := range registry {
+		deps = append(deps, dep)
+	}
+	sort.Slice(deps, func(i, j int) bool { return deps[i].Name() < deps[j].Name() })
+	return deps
+}
+
+func Get(name string) (Dependency, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	dep, ok := registry[name]
+	return dep, ok
+}
+
+// Names returns the names of every registered dependency.
+func Names() []string {
+	deps := All()
+	names := make([]string, 0, len(deps))
+	for _, dep := range deps {
+		names = append(names, dep.Name())
+	}
+	return names
+}
+
+// Enabled returns the registered dependencies enabled in config.
+func Enabled(cfg *config.Config) []Dependency {
+	var deps []Dependency
+	for _, dep := range All() {
+		if IsEnabled(cfg, dep) {
+			deps = append(deps, dep)
+		}
+	}
+	return deps
+}
+
+// IsEnabled reports whether the config enables dep, falling back to the
+// dependency's default.
+func IsEnabled(cfg *config.Config, dep Dependency) bool {
+	if enabled, set := cfg.DependencyEnabled(dep.Name()); set {
+		return enabled
+	}
+	if optional, ok := dep.(Optional); ok {
+		return optional.EnabledByDefault()
+	}
+	return true
+}
+
+// IsEnabledByName is IsEnabled for a dependency name; unknown dependencies
+// are never enabled.
+func IsEnabledByName(cfg *config.Config, name string) bool {
+	dep, ok := Get(name)
+	return ok && IsEnabled(cfg, dep)
+}
+
+// Selected returns the enabled dependencies, restricted to only when it is
+// not empty. Naming an unknown or disabled dependency is an error. cfg must
+// have been validated.
+func Selected(cfg *config.Config, only []string) ([]Dependency, error) {
+	if len(only) == 0 {
+		return Enabled(cfg), nil
+	}
+
+	deps := make([]Dependency, 0, len(only))
+	for _, name := range only {
+		dep, ok := Get(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown dependency %q (known: %s)", name, strings.Join(Names(), ", "))
+		}
+		if !IsEnabled(cfg, dep) {
+			return nil, fmt.Errorf("dependency %s is disabled in config", name)
+		}
+		deps = append(deps, dep)
+	}
+	return deps, nil
+}
+
+// Validate runs the checks of the given dependencies that implement Validator.
+func Validate(cfg *config.Config, deps []Dependency) error {
+	for _, dep := range deps {
+		validator, ok := dep.(Validator)
+		if !ok {
+			continue
+		}
+		if err := validator.Validate(cfg); err != nil {
+			return fmt.Errorf("dependency %s: %w", dep.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Fingerprint hashes everything that should trigger a reinstall: the rendered
+// manifest and the dependency's own config hash.
+func Fingerprint(cfg *config.Config, dep Dependency) (string, error) {
+	rendered, err := dep.Render(cfg)
+	if err != nil {
+		return "", err
+	}
+	configHash, err := dep.ConfigHash(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	hasher := sha256.New()
+	hasher.Write(rendered)
+	hasher.Write([]byte(configHash))
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// HashManifest is the ConfigHash of dependencies fully described by their
+// rendered manifest.
+func HashManifest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,82 @@
+package fakesmtp
+
+import (
+	"fmt"
+
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"github.com/yyewolf/kaloupile/pkg/dependencies"
+)
+
+const (
+	Name         = "fake-smtp"
+	ManifestPath = "cluster/dependencies/fake-smtp/fake-smtp.yaml"
+	SMTPNodePort = 31025
+	WebNodePort  = 31080
+)
+
+func init() {
+	dependencies.Register(&Dependency{ManifestPath: ManifestPath})
+}
+
+type Dependency struct {
+	ManifestPath string
+}
+
+func (d *Dependency) Name() string {
+	return Name
+}
+
+func (d *Dependency) PortMappings() []config.PortMapping {
+	return []config.PortMapping{
+		{Name: Name, ContainerPort: SMTPNodePort, HostPort: 1025, Protocol: "TCP"},
+		{Name: Name + "-web", ContainerPort: WebNodePort, HostPort: 1080, Protocol: "TCP"},
+	}
+}
+
+func (d *Dependency) Render(cfg *config.Config) ([]byte, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	return dependencies.RenderTemplate(d.ManifestPath, cfg)
+}
+
+func (d *Dependency) Install(cfg *config.Config) error {
+	rendered, err := d.Render(cfg)
+	if err != nil {
+		return err
+	}
+	if err := dependencies.RequireKubectl(); err != nil {
+		return err
+	}
+	return dependencies.ApplyManifest(cfg.KubeContext(), rendered)
+}
+
+func (d *Dependency) Ready(cfg *config.Config) (bool, string, error) {
+	if cfg == nil {
+		return false, "", fmt.Errorf("config is nil")
+	}
+	return dependencies.DeploymentReady(cfg.KubeContext(), dependencies.Namespace, "fake-smtp")
+}
+
+func (d *Dependency) Resources(cfg *config.Config) []dependencies.Resource {
+	return []dependencies.Resource{{Kind: "Deployment", Namespace: dependencies.Namespace, Name: "fake-smtp"}}
+}
+
+func (d *Dependency) Uninstall(cfg *config.Config) error {
+	rendered, err := d.Render(cfg)
+	if err != nil {
+		return err
+	}
+	if err := dependencies.RequireKubectl(); err != nil {
+		return err
+	}
+	return dependencies.DeleteManifest(cfg.KubeContext(), rendered)
+}
+
+func (d *Dependency) ConfigHash(cfg *config.Config) (string, error) {
+	rendered, err := d.Render(cfg)
+	if err != nil {
+		return "", err
+	}
+	return dependencies.HashManifest(rendered), nil
+}
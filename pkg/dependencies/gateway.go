@@ -0,0 +1,29 @@
+package dependencies
+
+import (
+	"time"
+
+	"github.com/yyewolf/kaloupile/pkg/config"
+)
+
+// The main Gateway is installed with the prerequisites; routes attach to it.
+const (
+	GatewayName      = "main-gateway"
+	GatewayNamespace = "gateway"
+)
+
+// WaitGateway waits for the main Gateway to be Programmed, which means the
+// gateway controller deployed its proxy and routes can be served.
+func WaitGateway(cfg *config.Config, timeout time.Duration) error {
+	kubeContext := cfg.KubeContext()
+	err := WaitFor("gateway "+GatewayName, timeout, func() (bool, string, error) {
+		return ConditionTrue(kubeContext, "gateway", GatewayNamespace, GatewayName, "Programmed")
+	})
+	if err != nil {
+		Diagnose(kubeContext, []Resource{
+			{Kind: "Gateway", Namespace: GatewayNamespace, Name: GatewayName},
+			{Kind: "Deployment", Namespace: GatewayNamespace, Name: GatewayName},
+		})
+	}
+	return err
+}
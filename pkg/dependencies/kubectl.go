@@ -0,0 +1,295 @@
+package dependencies
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/yyewolf/kaloupile/pkg/config"
+)
+
+// RequireKubectl fails early when kubectl is missing.
+func RequireKubectl() error {
+	if _, err := exec.LookPath("kubectl"); err != nil {
+		return fmt.Errorf("kubectl not found in PATH: %w", err)
+	}
+	return nil
+}
+
+// RenderTemplate renders a manifest template with the config as data.
+func RenderTemplate(path string, data any) ([]byte, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("resolve template path %s: %w", path, err)
+	}
+
+	content, err := os.ReadFile(absPath)
+	if err != nil {
+		return nil, fmt.Errorf("read template %s: %w", absPath, err)
+	}
+
+	tmpl, err := template.New(filepath.Base(absPath)).Funcs(template.FuncMap{
+		"b64enc": func(input string) string {
+			return base64.StdEncoding.EncodeToString([]byte(input))
+		},
+		// quote renders a YAML double-quoted string, escapes included.
+		"quote": strconv.Quote,
+	}).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("parse template %s: %w", absPath, err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("render template %s: %w", absPath, err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func NamespaceAnnotation(kubeContext, namespace, key string) (string, bool, error) {
+	output, err := RunKubectl(kubeContext, "get", "namespace", namespace, "-o", "jsonpath={.metadata.annotations}")
+	if err != nil {
+		if IsNotFound(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+
+	annotations := parseAnnotations(output)
+	value, exists := annotations[key]
+
+	return strings.TrimSpace(value), exists, nil
+}
+
+// DeploymentReady reports whether a Deployment finished rolling out and every
+// desired replica is ready, with a "ready/desired" detail.
+func DeploymentReady(kubeContext, namespace, name string) (bool, string, error) {
+	output, err := RunKubectl(kubeContext, "get", "deployment", name, "-n", namespace, "-o", "json")
+	if err != nil {
+		if IsNotFound(err) {
+			return false, "deployment " + name + " not found", nil
+		}
+		return false, "", err
+	}
+
+	var deployment struct {
+		Metadata struct {
+			Generation int64 `json:"generation"`
+		} `json:"metadata"`
+		Spec struct {
+			Replicas *int `json:"replicas"`
+		} `json:"spec"`
+		Status struct {
+			ObservedGeneration int64 `json:"observedGeneration"`
+			Replicas           int   `json:"replicas"`
+			UpdatedReplicas    int   `json:"updatedReplicas"`
+			ReadyReplicas      int   `json:"readyReplicas"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal([]byte(output), &deployment); err != nil {
+		return false, "", fmt.Errorf("parse deployment %s: %w", name, err)
+	}
+
+	desired := 1
+	if deployment.Spec.Replicas != nil {
+		desired = *deployment.Spec.Replicas
+	}
+
+	status := deployment.Status
+	switch {
+	case status.ObservedGeneration < deployment.Metadata.Generation:
+		return false, name + " rollout pending", nil
+	case status.UpdatedReplicas < desired:
+		return false, fmt.Sprintf("%s rolling out, %d/%d updated", name, status.UpdatedReplicas, desired), nil
+	case status.Replicas > status.UpdatedReplicas:
+		return false, fmt.Sprintf("%s rolling out, %d old replicas pending termination", name, status.Replicas-status.UpdatedReplicas), nil
+	}
+
+	detail := fmt.Sprintf("%s %d/%d ready", name, status.ReadyReplicas, desired)
+	return status.ReadyReplicas >= desired, detail, nil
+}
+
+// ConditionTrue reports whether the status condition of the given type is
+// True on an object, e.g. a Certificate Ready or a Gateway Programmed.
+func ConditionTrue(kubeContext, kind, namespace, name, conditionType string) (bool, string, error) {
+	output, err := RunKubectl(kubeContext, "get", kind, name, "-n", namespace, "-o", "json")
+	if err != nil {
+		if IsNotFound(err) {
+			return false, kind + " " + name + " not found", nil
+		}
+		return false, "", err
+	}
+
+	var object struct {
+		Status struct {
+			Conditions []struct {
+				Type    string `json:"type"`
+				Status  string `json:"status"`
+				Message string `json:"message"`
+			} `json:"conditions"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal([]byte(output), &object); err != nil {
+		return false, "", fmt.Errorf("parse %s %s: %w", kind, name, err)
+	}
+
+	for _, condition := range object.Status.Conditions {
+		if condition.Type != conditionType {
+			continue
+		}
+		if condition.Status == "True" {
+			return true, fmt.Sprintf("%s %s %s", kind, name, strings.ToLower(conditionType)), nil
+		}
+		return false, fmt.Sprintf("%s %s not %s: %s", kind, name, strings.ToLower(conditionType), condition.Message), nil
+	}
+
+	return false, fmt.Sprintf("%s %s has no %s condition yet", kind, name, conditionType), nil
+}
+
+func IsNotFound(err error) bool {
+	return strings.Contains(err.Error(), "NotFound") || strings.Contains(err.Error(), "not found")
+}
+
+func parseAnnotations(input string) map[string]string {
+	var annotations map[string]string
+	json.Unmarshal([]byte(input), &annotations)
+	return annotations
+}
+
+func DeleteManifest(kubeContext string, content []byte) error {
+	_, err := runKubectlStreamingWithStdin(kubeContext, bytes.NewReader(content), "delete", "-f", "-", "--wait=true", "--ignore-not-found")
+	return err
+}
+
+func ApplyManifest(kubeContext string, content []byte) error {
+	_, err := runKubectlStreamingWithStdin(kubeContext, bytes.NewReader(content), "apply", "-f", "-")
+	return err
+}
+
+// RemoveNamespaceAnnotation deletes key from namespace; a missing key is not
+// an error.
+func RemoveNamespaceAnnotation(kubeContext, namespace, key string) error {
+	_, err := runKubectlStreaming(kubeContext, "annotate", "namespace", namespace, key+"-")
+	return err
+}
+
+func AnnotateNamespace(kubeContext, namespace, key, value string) error {
+	annotation := fmt.Sprintf("%s=%s", key, value)
+	_, err := runKubectlStreaming(kubeContext, "annotate", "namespace", namespace, annotation, "--overwrite")
+	return err
+}
+
+func RunKubectl(kubeContext string, args ...string) (string, error) {
+	return RunCommand("kubectl", kubectlArgs(kubeContext, args)...)
+}
+
+// RunKubectlWithStdin runs kubectl with stdin attached, streaming its output.
+func RunKubectlWithStdin(kubeContext string, stdin io.Reader, args ...string) (string, error) {
+	return runKubectlStreamingWithStdin(kubeContext, stdin, args...)
+}
+
+// RunKubectlTo writes the standard output of kubectl to stdout, e.g. to save
+// a file copied out of a pod; only the standard error ends up in errors.
+func RunKubectlTo(kubeContext string, stdout io.Writer, args ...string) error {
+	args = kubectlArgs(kubeContext, args)
+	cmd := exec.Command("kubectl", args...)
+	var stderr bytes.Buffer
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("kubectl %s failed: %w: %s", config.Redact(strings.Join(args, " ")), err, config.Redact(strings.TrimSpace(stderr.String())))
+	}
+	return nil
+}
+
+func runKubectlStreaming(kubeContext string, args ...string) (string, error) {
+	return runCommandStreaming("kubectl", "kubectl", nil, kubectlArgs(kubeContext, args)...)
+}
+
+func runKubectlStreamingWithStdin(kubeContext string, stdin io.Reader, args ...string) (string, error) {
+	return runCommandStreaming("kubectl", "kubectl", stdin, kubectlArgs(kubeContext, args)...)
+}
+
+func kubectlArgs(kubeContext string, args []string) []string {
+	if kubeContext == "" {
+		return args
+	}
+	return append([]string{"--context", kubeContext}, args...)
+}
+
+// RunCommand runs bin and returns its combined output; errors carry that
+// output, with secrets redacted.
+func RunCommand(bin string, args ...string) (string, error) {
+	cmd := exec.Command(bin, args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s failed: %w: %s", bin, config.Redact(strings.Join(args, " ")), err, config.Redact(strings.TrimSpace(string(output))))
+	}
+	return string(output), nil
+}
+
+func runCommandStreaming(prefix, bin string, stdin io.Reader, args ...string) (string, error) {
+	cmd := exec.Command(bin, args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+
+	var output bytes.Buffer
+	stdoutWriter := newPrefixWriter(prefix, os.Stdout)
+	stderrWriter := newPrefixWriter(prefix, os.Stderr)
+	cmd.Stdout = io.MultiWriter(stdoutWriter, &output)
+	cmd.Stderr = io.MultiWriter(stderrWriter, &output)
+
+	err := cmd.Run()
+	_ = stdoutWriter.Flush()
+	_ = stderrWriter.Flush()
+	if err != nil {
+		return output.String(), fmt.Errorf("%s %s failed: %w: %s", bin, config.Redact(strings.Join(args, " ")), err, config.Redact(strings.TrimSpace(output.String())))
+	}
+
+	return output.String(), nil
+}
+
+type prefixWriter struct {
+	dst     io.Writer
+	prefix  string
+	pending string
+}
+
+func newPrefixWriter(prefix string, dst io.Writer) *prefixWriter {
+	return &prefixWriter{dst: dst, prefix: prefix}
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	chunk := w.pending + string(p)
+	lines := strings.Split(chunk, "\n")
+	for i := 0; i < len(lines)-1; i++ {
+		if _, err := fmt.Fprintf(w.dst, "[%s] %s\n", w.prefix, config.Redact(lines[i])); err != nil {
+			return len(p), err
+		}
+	}
+	w.pending = lines[len(lines)-1]
+	return len(p), nil
+}
+
+func (w *prefixWriter) Flush() error {
+	if w.pending == "" {
+		return nil
+	}
+	_, err := fmt.Fprintf(w.dst, "[%s] %s\n", w.prefix, config.Redact(w.pending))
+	w.pending = ""
+	return err
+}
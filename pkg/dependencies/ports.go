@@ -0,0 +1,16 @@
+package dependencies
+
+import "github.com/yyewolf/kaloupile/pkg/config"
+
+// ClusterPortMappings returns every host port mapping of the cluster: the
+// gateway, the S3 API, the enabled dependencies and the extra ports from cluster.ports.
+func ClusterPortMappings(cfg *config.Config) []config.PortMapping {
+	defaults := append([]config.PortMapping(nil), config.GatewayPortMappings...)
+	defaults = append(defaults, config.S3PortMappings...)
+	for _, dep := range Enabled(cfg) {
+		if mapper, ok := dep.(PortMapper); ok {
+			defaults = append(defaults, mapper.PortMappings()...)
+		}
+	}
+	return cfg.ResolvePorts(defaults)
+}
@@ -0,0 +1,93 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"github.com/yyewolf/kaloupile/pkg/dependencies"
+)
+
+// ConnectionParams resolves how to reach PostgreSQL from the host, honoring
+// the standard PGHOST, PGPORT and PGSSLMODE overrides.
+func ConnectionParams(cfg *config.Config) (host, port, sslmode string) {
+	host = envOr("PGHOST", cfg.Postgres.LocalHost)
+	if host == "" {
+		host = "localhost"
+	}
+	port = envOr("PGPORT", "")
+	if port == "" {
+		switch {
+		case cfg.Postgres.LocalPort > 0:
+			port = strconv.Itoa(cfg.Postgres.LocalPort)
+		default:
+			mapped := cfg.HostPort(dependencies.ClusterPortMappings(cfg), NodePort)
+			if mapped == 0 {
+				mapped = 5432
+			}
+			port = strconv.Itoa(mapped)
+		}
+	}
+	sslmode = envOr("PGSSLMODE", "disable")
+	return host, port, sslmode
+}
+
+// OpenDB returns a pool for dbName; it does not connect yet.
+func OpenDB(host, port, user, password, dbName, sslmode string) (*sql.DB, error) {
+	if dbName == "" {
+		return nil, fmt.Errorf("database name is empty")
+	}
+
+	dsn := fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		host,
+		port,
+		user,
+		password,
+		dbName,
+		sslmode,
+	)
+	return sql.Open("postgres", dsn)
+}
+
+// acceptsQueries connects to the admin database from the host like sync
+// does and runs a query, which the pod probes cannot tell: the port mapping
+// works, the admin credentials are accepted and initialization is over.
+func acceptsQueries(cfg *config.Config) (bool, string, error) {
+	host, port, sslmode := ConnectionParams(cfg)
+	admin := cfg.Postgres.Admin
+	db, err := OpenDB(host, port, admin.User, admin.Password, admin.Database, sslmode)
+	if err != nil {
+		return false, "", err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var one int
+	if err := db.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+		err = fmt.Errorf("query %s:%s as %s: %w", host, port, admin.User, err)
+		// Rejected credentials (class 28) do not fix themselves.
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code.Class() == "28" {
+			return false, "", dependencies.Permanent(err)
+		}
+		return false, fmt.Sprintf("not accepting queries on %s:%s yet", host, port), err
+	}
+	return true, fmt.Sprintf("accepting queries on %s:%s", host, port), nil
+}
+
+func envOr(key, fallback string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,183 @@
+package postgresql
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"github.com/yyewolf/kaloupile/pkg/dependencies"
+)
+
+const (
+	Name                 = "postgresql"
+	TemplatePath         = "cluster/dependencies/postgresql/postgresql.yaml"
+	ConfigHashAnnotation = "kaloupile.dev/postgresql-config-hash"
+	NodePort             = 30432
+)
+
+func init() {
+	dependencies.Register(&Dependency{TemplatePath: TemplatePath})
+}
+
+type Dependency struct {
+	TemplatePath string
+}
+
+func (d *Dependency) Name() string {
+	return Name
+}
+
+func (d *Dependency) PortMappings() []config.PortMapping {
+	return []config.PortMapping{
+		{Name: Name, ContainerPort: NodePort, HostPort: 5432, Protocol: "TCP"},
+	}
+}
+
+func (d *Dependency) Render(cfg *config.Config) ([]byte, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	return dependencies.RenderTemplate(d.TemplatePath, cfg)
+}
+
+func (d *Dependency) Install(cfg *config.Config) error {
+	if cfg == nil {
+		return fmt.Errorf("config is nil")
+	}
+	if err := dependencies.RequireKubectl(); err != nil {
+		return err
+	}
+
+	hash, err := d.ConfigHash(cfg)
+	if err != nil {
+		return err
+	}
+
+	kubeContext := cfg.KubeContext()
+	currentHash, exists, err := dependencies.NamespaceAnnotation(kubeContext, dependencies.Namespace, ConfigHashAnnotation)
+	if err != nil {
+		return err
+	}
+
+	rendered, err := d.Render(cfg)
+	if err != nil {
+		return err
+	}
+
+	image, installed, err := installedImage(kubeContext)
+	if err != nil {
+		return err
+	}
+	from, known := config.ImageMajorVersion(image)
+	to, _ := config.ImageMajorVersion(cfg.Postgres.Image)
+	if installed && known && from != to {
+		if to < from {
+			return fmt.Errorf("downgrading PostgreSQL from %d to %d is not supported: export what you need with kaloupile db snapshot --export and run kaloupile dependencies --only postgresql --reset-data", from, to)
+		}
+		// The restore runs on a fresh data directory initialized with the
+		// configured admin credentials, so there is nothing to rotate.
+		if err := upgrade(kubeContext, cfg, rendered, from, to); err != nil {
+			return err
+		}
+		return dependencies.AnnotateNamespace(kubeContext, dependencies.Namespace, ConfigHashAnnotation, hash)
+	}
+	if err := checkStorage(kubeContext, cfg); err != nil {
+		return err
+	}
+
+	// PostgreSQL only reads the admin credentials when initializing its data
+	// directory, so changing them takes an ALTER USER before the Secret is
+	// updated and the pod restarted on it.
+	rotate := exists && currentHash != hash
+	if rotate {
+		if err := rotateAdmin(kubeContext, cfg); err != nil {
+			return err
+		}
+	}
+
+	if err := dependencies.ApplyManifest(kubeContext, rendered); err != nil {
+		return err
+	}
+
+	if rotate {
+		fmt.Println("[postgresql] admin credentials changed, restarting postgresql")
+		if _, err := dependencies.RunKubectl(kubeContext, "rollout", "restart", "deployment/postgresql", "-n", dependencies.Namespace); err != nil {
+			return err
+		}
+	}
+
+	if err := dependencies.AnnotateNamespace(kubeContext, dependencies.Namespace, ConfigHashAnnotation, hash); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *Dependency) Ready(cfg *config.Config) (bool, string, error) {
+	if cfg == nil {
+		return false, "", fmt.Errorf("config is nil")
+	}
+
+	var details []string
+	for _, name := range []string{"postgresql", "pgweb"} {
+		ready, detail, err := dependencies.DeploymentReady(cfg.KubeContext(), dependencies.Namespace, name)
+		if err != nil || !ready {
+			return false, detail, err
+		}
+		details = append(details, detail)
+	}
+
+	ready, detail, err := acceptsQueries(cfg)
+	if err != nil || !ready {
+		return false, detail, err
+	}
+	details = append(details, detail)
+
+	return true, strings.Join(details, ", "), nil
+}
+
+func (d *Dependency) Resources(cfg *config.Config) []dependencies.Resource {
+	return []dependencies.Resource{
+		{Kind: "Deployment", Namespace: dependencies.Namespace, Name: "postgresql"},
+		{Kind: "PersistentVolumeClaim", Namespace: dependencies.Namespace, Name: "postgresql-pvc"},
+		{Kind: "Deployment", Namespace: dependencies.Namespace, Name: "pgweb"},
+	}
+}
+
+// ResetData deletes everything, postgresql-pvc included, so that the next
+// Install initializes a new data directory with the configured admin user.
+func (d *Dependency) ResetData(cfg *config.Config) error {
+	if cfg == nil {
+		return fmt.Errorf("config is nil")
+	}
+	if err := d.Uninstall(cfg); err != nil {
+		return err
+	}
+	return dependencies.RemoveNamespaceAnnotation(cfg.KubeContext(), dependencies.Namespace, ConfigHashAnnotation)
+}
+
+func (d *Dependency) Uninstall(cfg *config.Config) error {
+	rendered, err := d.Render(cfg)
+	if err != nil {
+		return err
+	}
+	if err := dependencies.RequireKubectl(); err != nil {
+		return err
+	}
+	return dependencies.DeleteManifest(cfg.KubeContext(), rendered)
+}
+
+// ConfigHash covers the admin credentials, which Install rotates in place
+// when they change.
+func (d *Dependency) ConfigHash(cfg *config.Config) (string, error) {
+	if cfg == nil {
+		return "", fmt.Errorf("config is nil")
+	}
+
+	admin := cfg.Postgres.Admin
+	input := fmt.Sprintf("user=%s\npassword=%s\ndatabase=%s\n", admin.User, admin.Password, admin.Database)
+	sum := sha256.Sum256([]byte(input))
+	return hex.EncodeToString(sum[:]), nil
+}
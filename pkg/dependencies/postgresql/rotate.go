@@ -0,0 +1,147 @@
+package postgresql
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"github.com/yyewolf/kaloupile/pkg/dependencies"
+)
+
+type adminCredentials struct {
+	User     string
+	Password string
+	Database string
+}
+
+// rotateAdmin brings the running PostgreSQL to the configured admin
+// credentials. The official image trusts every connection from inside the
+// pod, so logging in proves nothing: the installed password read from the
+// cluster is checked against the verifier in pg_authid instead. When it does
+// not match, an earlier rotation got past ALTER USER without updating the
+// Secret, which the configured password matching confirms. A password
+// matching neither was changed by hand and is left alone.
+func rotateAdmin(kubeContext string, cfg *config.Config) error {
+	installed, found, err := installedAdmin(kubeContext)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return nil
+	}
+
+	admin := cfg.Postgres.Admin
+	wanted := adminCredentials{User: admin.User, Password: admin.Password, Database: admin.Database}
+	script := rotationScript(installed, wanted)
+	if script == "" {
+		return nil
+	}
+
+	verifiers, err := passwordVerifiers(kubeContext, installed, wanted.User)
+	if err != nil {
+		return fmt.Errorf("read admin password verifiers: %w", err)
+	}
+	if !VerifierMatches(verifiers[installed.User], installed.User, installed.Password) &&
+		!VerifierMatches(verifiers[wanted.User], wanted.User, wanted.Password) {
+		return fmt.Errorf("the password of %s matches neither postgresql-secret nor postgres.admin.password, it was changed outside kaloupile: set it back, or export what you need with kaloupile db snapshot --export and run kaloupile dependencies --only postgresql --reset-data", installed.User)
+	}
+
+	fmt.Println("[postgresql] rotating admin credentials in place")
+	if err := runPSQL(kubeContext, installed, script); err != nil {
+		return fmt.Errorf("rotate admin credentials: %w", err)
+	}
+	return nil
+}
+
+// rotationScript returns the psql script turning installed into wanted. The
+// role the data directory was initialized with cannot be renamed or dropped,
+// so a new admin user is a new superuser and the old one loses its password.
+func rotationScript(installed, wanted adminCredentials) string {
+	var script strings.Builder
+	role := pq.QuoteIdentifier(wanted.User)
+	password := pq.QuoteLiteral(wanted.Password)
+
+	switch {
+	case installed.User != wanted.User:
+		fmt.Fprintf(&script, "SELECT format('CREATE ROLE %%I', %s) WHERE NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = %s) \\gexec\n",
+			pq.QuoteLiteral(wanted.User), pq.QuoteLiteral(wanted.User))
+		fmt.Fprintf(&script, "ALTER ROLE %s WITH SUPERUSER CREATEDB CREATEROLE REPLICATION BYPASSRLS LOGIN PASSWORD %s;\n", role, password)
+		fmt.Fprintf(&script, "ALTER ROLE %s WITH PASSWORD NULL;\n", pq.QuoteIdentifier(installed.User))
+	case installed.Password != wanted.Password:
+		fmt.Fprintf(&script, "ALTER USER %s WITH PASSWORD %s;\n", role, password)
+	}
+
+	if installed.Database != wanted.Database {
+		fmt.Fprintf(&script, "SELECT format('CREATE DATABASE %%I OWNER %%I', %s, %s) WHERE NOT EXISTS (SELECT 1 FROM pg_database WHERE datname = %s) \\gexec\n",
+			pq.QuoteLiteral(wanted.Database), pq.QuoteLiteral(wanted.User), pq.QuoteLiteral(wanted.Database))
+	}
+
+	return script.String()
+}
+
+// installedAdmin reads the admin credentials from the installed ConfigMap and
+// Secret; found is false when PostgreSQL is not installed.
+func installedAdmin(kubeContext string) (adminCredentials, bool, error) {
+	var credentials adminCredentials
+	for _, value := range []struct {
+		kind, name, key string
+		target          *string
+		encoded         bool
+	}{
+		{"configmap", "postgresql-config", "POSTGRES_USER", &credentials.User, false},
+		{"configmap", "postgresql-config", "POSTGRES_DB", &credentials.Database, false},
+		{"secret", "postgresql-secret", "POSTGRES_PASSWORD", &credentials.Password, true},
+	} {
+		output, err := dependencies.RunKubectl(kubeContext, "get", value.kind, value.name, "-n", dependencies.Namespace, "-o", "jsonpath={.data."+value.key+"}")
+		if err != nil {
+			if dependencies.IsNotFound(err) {
+				return adminCredentials{}, false, nil
+			}
+			return adminCredentials{}, false, err
+		}
+		output = strings.TrimSpace(output)
+		if value.encoded {
+			decoded, err := base64.StdEncoding.DecodeString(output)
+			if err != nil {
+				return adminCredentials{}, false, fmt.Errorf("decode %s/%s: %w", value.name, value.key, err)
+			}
+			output = string(decoded)
+		}
+		*value.target = output
+	}
+	return credentials, true, nil
+}
+
+// passwordVerifiers returns the pg_authid.rolpassword of the installed admin
+// and of user, keyed by role; a role without a password or missing is absent.
+func passwordVerifiers(kubeContext string, installed adminCredentials, user string) (map[string]string, error) {
+	query := fmt.Sprintf("SELECT rolname, rolpassword FROM pg_authid WHERE rolname IN (%s, %s) AND rolpassword IS NOT NULL",
+		pq.QuoteLiteral(installed.User), pq.QuoteLiteral(user))
+	var output bytes.Buffer
+	if err := dependencies.RunKubectlTo(kubeContext, &output,
+		"exec", "-n", dependencies.Namespace, "deploy/postgresql", "--",
+		"psql", "--username", installed.User, "--dbname", installed.Database, "--no-align", "--tuples-only", "--field-separator", " ", "--command", query); err != nil {
+		return nil, err
+	}
+
+	verifiers := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		if name, verifier, ok := strings.Cut(line, " "); ok {
+			verifiers[name] = verifier
+		}
+	}
+	return verifiers, nil
+}
+
+// runPSQL runs script with psql in the postgresql pod over the socket, as the
+// installed admin. Scripts carry passwords, so they go through stdin to stay
+// out of the process list.
+func runPSQL(kubeContext string, installed adminCredentials, script string) error {
+	_, err := dependencies.RunKubectlWithStdin(kubeContext, strings.NewReader(script),
+		"exec", "-i", "-n", dependencies.Namespace, "deploy/postgresql", "--",
+		"psql", "--username", installed.User, "--dbname", installed.Database, "--set", "ON_ERROR_STOP=1", "--quiet")
+	return err
+}
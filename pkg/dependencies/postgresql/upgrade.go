@@ -0,0 +1,195 @@
+package postgresql
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"github.com/yyewolf/kaloupile/pkg/dependencies"
+)
+
+// installedImage returns the image of the installed postgresql Deployment;
+// found is false when it is not installed.
+func installedImage(kubeContext string) (string, bool, error) {
+	output, err := dependencies.RunKubectl(kubeContext, "get", "deployment", "postgresql", "-n", dependencies.Namespace, "-o", "jsonpath={.spec.template.spec.containers[0].image}")
+	if err != nil {
+		if dependencies.IsNotFound(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return strings.TrimSpace(output), true, nil
+}
+
+// checkStorage fails when postgres.storage differs from the size of the
+// existing volume, which the default Kind storage class cannot resize.
+func checkStorage(kubeContext string, cfg *config.Config) error {
+	output, err := dependencies.RunKubectl(kubeContext, "get", "pvc", "postgresql-pvc", "-n", dependencies.Namespace, "-o", "jsonpath={.spec.resources.requests.storage}")
+	if err != nil {
+		if dependencies.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	size := strings.TrimSpace(output)
+	current, err := config.ParseQuantity(size)
+	if err != nil {
+		return fmt.Errorf("size of postgresql-pvc: %w", err)
+	}
+	wanted, err := config.ParseQuantity(cfg.Postgres.Storage)
+	if err != nil {
+		return fmt.Errorf("postgres.storage: %w", err)
+	}
+	if current.Cmp(wanted) != 0 {
+		return fmt.Errorf("postgresql-pvc is %s but postgres.storage is %s: the volume cannot be resized in place, export what you need with kaloupile db snapshot --export and run kaloupile dependencies --only postgresql --reset-data", size, cfg.Postgres.Storage)
+	}
+	return nil
+}
+
+// upgrade moves the data to a new major version, which cannot read the data
+// directory of the old one: every database is dumped to the host with
+// pg_dumpall, the volume is recreated for the new image, and the dump is
+// restored. Nothing is deleted unless the dump succeeded, and the dump is
+// kept afterwards.
+func upgrade(kubeContext string, cfg *config.Config, rendered []byte, from, to int) error {
+	fmt.Printf("[postgresql] upgrading PostgreSQL %d to %d: dump every database, recreate postgresql-pvc with %s, restore\n", from, to, cfg.Postgres.Image)
+	fmt.Println("[postgresql] snapshots are not carried over, export them first with kaloupile db snapshot --export if needed")
+
+	installed, found, err := installedAdmin(kubeContext)
+	if err != nil {
+		return err
+	}
+	if !found {
+		admin := cfg.Postgres.Admin
+		installed = adminCredentials{User: admin.User, Password: admin.Password, Database: admin.Database}
+	}
+
+	if err := os.MkdirAll(cfg.StateDir(), 0o755); err != nil {
+		return fmt.Errorf("create state dir: %w", err)
+	}
+	dumpPath := filepath.Join(cfg.StateDir(), fmt.Sprintf("postgresql-%d-%s.sql", from, time.Now().Format("20060102-150405")))
+
+	fmt.Printf("[postgresql] 1/3 dumping PostgreSQL %d to %s\n", from, dumpPath)
+	if err := dumpAll(kubeContext, installed.User, dumpPath); err != nil {
+		return fmt.Errorf("dump PostgreSQL %d: %w; nothing was deleted", from, err)
+	}
+
+	fmt.Printf("[postgresql] 2/3 recreating postgresql-pvc for PostgreSQL %d\n", to)
+	if err := dependencies.DeleteManifest(kubeContext, rendered); err != nil {
+		return fmt.Errorf("delete PostgreSQL %d, the dump is in %s: %w", from, dumpPath, err)
+	}
+	if err := dependencies.ApplyManifest(kubeContext, rendered); err != nil {
+		return fmt.Errorf("install PostgreSQL %d, the dump is in %s: %w", to, dumpPath, err)
+	}
+	// The image initializes the data directory with a server only listening
+	// on the socket, so the TCP port answering means initialization is over.
+	if err := dependencies.WaitFor("postgresql", dependencies.DefaultWaitTimeout, func() (bool, string, error) {
+		_, err := dependencies.RunKubectl(kubeContext, "exec", "-n", dependencies.Namespace, "deploy/postgresql", "--", "pg_isready", "-h", "127.0.0.1")
+		if err != nil {
+			return false, "", err
+		}
+		return true, "accepting connections", nil
+	}); err != nil {
+		return fmt.Errorf("wait for PostgreSQL %d, the dump is in %s: %w", to, dumpPath, err)
+	}
+
+	fmt.Printf("[postgresql] 3/3 restoring %s into PostgreSQL %d\n", dumpPath, to)
+	if err := restoreAll(kubeContext, cfg, dumpPath); err != nil {
+		return fmt.Errorf("restore PostgreSQL %d, the dump is kept in %s: %w", to, dumpPath, err)
+	}
+
+	fmt.Printf("[postgresql] upgraded to PostgreSQL %d, the dump is kept in %s\n", to, dumpPath)
+	return nil
+}
+
+func dumpAll(kubeContext, user, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = dependencies.RunKubectlTo(kubeContext, file, "exec", "-n", dependencies.Namespace, "deploy/postgresql", "--", "pg_dumpall", "--username", user)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+	}
+	return err
+}
+
+// restoreAll replays the dump with psql over the socket and stops at the
+// first error. The admin role and database already exist in the new data
+// directory, so their CREATE statements are left out. The dump carries the
+// password the admin had before, so the configured one is set again at the
+// end.
+func restoreAll(kubeContext string, cfg *config.Config, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	admin := cfg.Postgres.Admin
+	dump := skipLines(file, createdByInit(admin.User, admin.Database))
+	defer dump.Close()
+
+	reset := fmt.Sprintf("\n\\connect %s\nALTER USER %s WITH PASSWORD %s;\n", pq.QuoteIdentifier(admin.Database), pq.QuoteIdentifier(admin.User), pq.QuoteLiteral(admin.Password))
+	_, err = dependencies.RunKubectlWithStdin(kubeContext, io.MultiReader(dump, strings.NewReader(reset)),
+		"exec", "-i", "-n", dependencies.Namespace, "deploy/postgresql", "--",
+		"psql", "--username", admin.User, "--dbname", admin.Database, "--quiet", "--output", "/dev/null", "--set", "ON_ERROR_STOP=1")
+	return err
+}
+
+// createdByInit matches the lines of a pg_dumpall dump creating what the
+// image creates when it initializes the data directory: the admin role and
+// the admin database. pg_dumpall only quotes names when it has to, and
+// writes the options of a database after its name.
+func createdByInit(user, database string) func(line string) bool {
+	var roles, databases []string
+	for _, name := range []string{user, pq.QuoteIdentifier(user)} {
+		roles = append(roles, "CREATE ROLE "+name+";")
+	}
+	for _, name := range []string{database, pq.QuoteIdentifier(database)} {
+		databases = append(databases, "CREATE DATABASE "+name+";", "CREATE DATABASE "+name+" ")
+	}
+	return func(line string) bool {
+		if slices.Contains(roles, line) {
+			return true
+		}
+		return slices.ContainsFunc(databases, func(prefix string) bool {
+			return strings.HasPrefix(line, prefix)
+		})
+	}
+}
+
+// skipLines streams r without the lines skip matches.
+func skipLines(r io.Reader, skip func(line string) bool) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		reader := bufio.NewReader(r)
+		for {
+			text, err := reader.ReadString('\n')
+			if !skip(strings.TrimSuffix(text, "\n")) {
+				if _, writeErr := io.WriteString(pw, text); writeErr != nil {
+					return
+				}
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return pr
+}
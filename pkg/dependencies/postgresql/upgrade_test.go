@@ -0,0 +1,56 @@
+package postgresql
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestSkipLinesLeavesOutAdminRoleAndDatabase(t *testing.T) {
+	dump := strings.Join([]string{
+		"CREATE ROLE app;",
+		"ALTER ROLE app WITH SUPERUSER INHERIT CREATEROLE CREATEDB LOGIN PASSWORD 'SCRAM-SHA-256$4096:c2FsdA==$a:b';",
+		"CREATE ROLE basilic;",
+		"CREATE DATABASE app WITH TEMPLATE = template0 ENCODING = 'UTF8' LOCALE_PROVIDER = libc LOCALE = 'en_US.utf8';",
+		"ALTER DATABASE app OWNER TO app;",
+		"CREATE DATABASE app_test WITH TEMPLATE = template0 ENCODING = 'UTF8' LOCALE_PROVIDER = libc LOCALE = 'en_US.utf8';",
+		"CREATE DATABASE basilic WITH TEMPLATE = template0 ENCODING = 'UTF8' LOCALE_PROVIDER = libc LOCALE = 'en_US.utf8';",
+		"\\connect app",
+		"",
+	}, "\n")
+
+	reader := skipLines(strings.NewReader(dump), createdByInit("app", "app"))
+	defer reader.Close()
+	restored, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := strings.Join([]string{
+		"ALTER ROLE app WITH SUPERUSER INHERIT CREATEROLE CREATEDB LOGIN PASSWORD 'SCRAM-SHA-256$4096:c2FsdA==$a:b';",
+		"CREATE ROLE basilic;",
+		"ALTER DATABASE app OWNER TO app;",
+		"CREATE DATABASE app_test WITH TEMPLATE = template0 ENCODING = 'UTF8' LOCALE_PROVIDER = libc LOCALE = 'en_US.utf8';",
+		"CREATE DATABASE basilic WITH TEMPLATE = template0 ENCODING = 'UTF8' LOCALE_PROVIDER = libc LOCALE = 'en_US.utf8';",
+		"\\connect app",
+		"",
+	}, "\n")
+	if string(restored) != want {
+		t.Fatalf("restored dump:\n%s\nwant:\n%s", restored, want)
+	}
+}
+
+func TestCreatedByInitMatchesQuotedNames(t *testing.T) {
+	skip := createdByInit("Admin", "My App")
+	for _, line := range []string{
+		`CREATE ROLE "Admin";`,
+		`CREATE DATABASE "My App" WITH TEMPLATE = template0 ENCODING = 'UTF8';`,
+	} {
+		if !skip(line) {
+			t.Errorf("%s is restored, want it skipped", line)
+		}
+	}
+	if skip(`CREATE DATABASE "My App 2" WITH TEMPLATE = template0;`) {
+		t.Error("a database whose name starts with the admin database is skipped")
+	}
+}
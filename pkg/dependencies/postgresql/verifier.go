@@ -0,0 +1,67 @@
+package postgresql
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// VerifierMatches checks password against a role's pg_authid.rolpassword,
+// either a SCRAM-SHA-256 or an MD5 verifier. An empty verifier, a role
+// without a password, never matches.
+func VerifierMatches(verifier, name, password string) bool {
+	if strings.HasPrefix(verifier, "md5") {
+		sum := md5.Sum([]byte(password + name))
+		return verifier == "md5"+hex.EncodeToString(sum[:])
+	}
+	return scramMatches(verifier, password)
+}
+
+// scramMatches checks a SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+// verifier (RFC 5802, 7677). Passwords are not SASLprep normalized, which
+// only matters for non-ASCII passwords.
+func scramMatches(verifier, password string) bool {
+	rest, ok := strings.CutPrefix(verifier, "SCRAM-SHA-256$")
+	if !ok {
+		return false
+	}
+	params, keys, ok := strings.Cut(rest, "$")
+	if !ok {
+		return false
+	}
+	iterationsText, saltText, ok := strings.Cut(params, ":")
+	if !ok {
+		return false
+	}
+	storedKeyText, _, ok := strings.Cut(keys, ":")
+	if !ok {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(iterationsText)
+	if err != nil {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(saltText)
+	if err != nil {
+		return false
+	}
+	storedKey, err := base64.StdEncoding.DecodeString(storedKeyText)
+	if err != nil {
+		return false
+	}
+
+	salted, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, salted)
+	mac.Write([]byte("Client Key"))
+	clientKey := sha256.Sum256(mac.Sum(nil))
+	return hmac.Equal(clientKey[:], storedKey)
+}
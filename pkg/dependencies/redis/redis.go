@@ -0,0 +1,130 @@
+package redis
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"github.com/yyewolf/kaloupile/pkg/dependencies"
+)
+
+const (
+	Name                 = "redis"
+	TemplatePath         = "cluster/dependencies/redis/redis.yaml"
+	ConfigHashAnnotation = "kaloupile.dev/redis-config-hash"
+	NodePort             = 30379
+)
+
+func init() {
+	dependencies.Register(&Dependency{TemplatePath: TemplatePath})
+}
+
+type Dependency struct {
+	TemplatePath string
+}
+
+func (d *Dependency) Name() string {
+	return Name
+}
+
+// EnabledByDefault keeps Redis out of configs that never asked for it.
+func (d *Dependency) EnabledByDefault() bool {
+	return false
+}
+
+func (d *Dependency) PortMappings() []config.PortMapping {
+	return []config.PortMapping{
+		{Name: Name, ContainerPort: NodePort, HostPort: 6379, Protocol: "TCP"},
+	}
+}
+
+func (d *Dependency) Validate(cfg *config.Config) error {
+	if strings.TrimSpace(cfg.Redis.Admin.Password) == "" {
+		return fmt.Errorf("missing required config: redis.admin.password")
+	}
+	return nil
+}
+
+func (d *Dependency) Render(cfg *config.Config) ([]byte, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	return dependencies.RenderTemplate(d.TemplatePath, cfg)
+}
+
+func (d *Dependency) Install(cfg *config.Config) error {
+	if cfg == nil {
+		return fmt.Errorf("config is nil")
+	}
+	if err := d.Validate(cfg); err != nil {
+		return err
+	}
+	if err := dependencies.RequireKubectl(); err != nil {
+		return err
+	}
+
+	hash, err := d.ConfigHash(cfg)
+	if err != nil {
+		return err
+	}
+
+	kubeContext := cfg.KubeContext()
+	currentHash, exists, err := dependencies.NamespaceAnnotation(kubeContext, dependencies.Namespace, ConfigHashAnnotation)
+	if err != nil {
+		return err
+	}
+
+	rendered, err := d.Render(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Redis reads the password from its arguments, so a new secret alone would
+	// not reach the running pod.
+	if exists && currentHash != hash {
+		if err := dependencies.DeleteManifest(kubeContext, rendered); err != nil {
+			return err
+		}
+	}
+
+	if err := dependencies.ApplyManifest(kubeContext, rendered); err != nil {
+		return err
+	}
+
+	return dependencies.AnnotateNamespace(kubeContext, dependencies.Namespace, ConfigHashAnnotation, hash)
+}
+
+func (d *Dependency) Ready(cfg *config.Config) (bool, string, error) {
+	if cfg == nil {
+		return false, "", fmt.Errorf("config is nil")
+	}
+	return dependencies.DeploymentReady(cfg.KubeContext(), dependencies.Namespace, "redis")
+}
+
+func (d *Dependency) Resources(cfg *config.Config) []dependencies.Resource {
+	return []dependencies.Resource{{Kind: "Deployment", Namespace: dependencies.Namespace, Name: "redis"}}
+}
+
+func (d *Dependency) Uninstall(cfg *config.Config) error {
+	rendered, err := d.Render(cfg)
+	if err != nil {
+		return err
+	}
+	if err := dependencies.RequireKubectl(); err != nil {
+		return err
+	}
+	return dependencies.DeleteManifest(cfg.KubeContext(), rendered)
+}
+
+// ConfigHash covers the default user password. ACL users are not part of it:
+// sync reconciles them against the running server.
+func (d *Dependency) ConfigHash(cfg *config.Config) (string, error) {
+	if cfg == nil {
+		return "", fmt.Errorf("config is nil")
+	}
+
+	sum := sha256.Sum256([]byte("password=" + cfg.Redis.Admin.Password + "\n"))
+	return hex.EncodeToString(sum[:]), nil
+}
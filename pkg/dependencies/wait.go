@@ -0,0 +1,215 @@
+package dependencies
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yyewolf/kaloupile/pkg/config"
+)
+
+// DefaultWaitTimeout bounds how long an install waits for readiness.
+const DefaultWaitTimeout = 5 * time.Minute
+
+const (
+	waitInterval  = 2 * time.Second
+	progressEvery = 30 * time.Second
+	logTailLines  = "50"
+)
+
+// Resource names a cluster object inspected when a wait times out: its
+// events, and for Deployments the events and logs of their pods.
+type Resource struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+// Diagnosable is implemented by dependencies listing the objects to inspect
+// when they do not become ready.
+type Diagnosable interface {
+	Resources(cfg *config.Config) []Resource
+}
+
+// PermanentError stops WaitFor right away, for failures that waiting cannot
+// fix such as rejected credentials.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent marks err as a PermanentError.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// WaitReady polls dep.Ready until it succeeds or timeout elapses, printing
+// progress. On timeout it prints the events and logs of the dependency's
+// resources. A zero timeout skips waiting.
+func WaitReady(cfg *config.Config, dep Dependency, timeout time.Duration) error {
+	if cfg == nil {
+		return fmt.Errorf("config is nil")
+	}
+
+	err := WaitFor(dep.Name(), timeout, func() (bool, string, error) {
+		return dep.Ready(cfg)
+	})
+	if err != nil {
+		if diagnosable, ok := dep.(Diagnosable); ok {
+			Diagnose(cfg.KubeContext(), diagnosable.Resources(cfg))
+		}
+	}
+	return err
+}
+
+// WaitFor polls check every few seconds until it reports ready. Errors from
+// check are treated as "not ready yet" since the API server or CRDs may still
+// be coming up; the last one is returned on timeout. A PermanentError is
+// returned at once.
+func WaitFor(name string, timeout time.Duration, check func() (bool, string, error)) error {
+	if timeout <= 0 {
+		return nil
+	}
+
+	start := time.Now()
+	deadline := start.Add(timeout)
+	lastDetail := ""
+	lastProgress := start
+
+	for {
+		ready, detail, err := check()
+		var permanent *PermanentError
+		if errors.As(err, &permanent) {
+			return fmt.Errorf("%s not ready: %w", name, permanent.Err)
+		}
+		if err != nil {
+			detail = err.Error()
+		}
+		elapsed := time.Since(start).Round(time.Second)
+
+		if ready {
+			fmt.Printf("[wait] %s ready after %s (%s)\n", name, elapsed, config.Redact(detail))
+			return nil
+		}
+
+		switch {
+		case detail != lastDetail:
+			fmt.Printf("[wait] %s: %s\n", name, config.Redact(detail))
+			lastDetail, lastProgress = detail, time.Now()
+		case time.Since(lastProgress) >= progressEvery:
+			fmt.Printf("[wait] %s: still waiting after %s: %s\n", name, elapsed, config.Redact(detail))
+			lastProgress = time.Now()
+		}
+
+		if time.Now().Add(waitInterval).After(deadline) {
+			if err != nil {
+				return fmt.Errorf("%s not ready after %s: %w", name, timeout, err)
+			}
+			return fmt.Errorf("%s not ready after %s: %s", name, timeout, detail)
+		}
+		time.Sleep(waitInterval)
+	}
+}
+
+// Diagnose prints the events of every resource and, for Deployments, the
+// events and recent container logs of their pods. Failures are printed
+// rather than returned: diagnostics must not hide the original error.
+func Diagnose(kubeContext string, resources []Resource) {
+	for _, resource := range resources {
+		printEvents(kubeContext, resource)
+
+		if resource.Kind != "Deployment" {
+			continue
+		}
+		pods, err := deploymentPods(kubeContext, resource.Namespace, resource.Name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[diagnose] list pods of %s/%s: %v\n", resource.Namespace, resource.Name, err)
+			continue
+		}
+		for _, pod := range pods {
+			printEvents(kubeContext, Resource{Kind: "Pod", Namespace: resource.Namespace, Name: pod})
+			printLogs(kubeContext, resource.Namespace, pod)
+		}
+	}
+}
+
+func printEvents(kubeContext string, resource Resource) {
+	label := fmt.Sprintf("events %s %s/%s", resource.Kind, resource.Namespace, resource.Name)
+	output, err := RunKubectl(kubeContext, "get", "events", "-n", resource.Namespace,
+		"--field-selector", fmt.Sprintf("involvedObject.kind=%s,involvedObject.name=%s", resource.Kind, resource.Name),
+		"--sort-by=.lastTimestamp")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[diagnose] %s: %v\n", label, err)
+		return
+	}
+	printBlock(label, output)
+}
+
+func printLogs(kubeContext, namespace, pod string) {
+	label := fmt.Sprintf("logs %s/%s", namespace, pod)
+	output, err := RunKubectl(kubeContext, "logs", pod, "-n", namespace, "--all-containers", "--prefix", "--tail", logTailLines)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[diagnose] %s: %v\n", label, err)
+		return
+	}
+	printBlock(label, output)
+}
+
+func printBlock(label, output string) {
+	output = strings.TrimSpace(output)
+	if output == "" {
+		output = "(none)"
+	}
+	writer := newPrefixWriter("diagnose", os.Stderr)
+	fmt.Fprintf(writer, "--- %s\n%s\n", label, output)
+	_ = writer.Flush()
+}
+
+// deploymentPods lists the pods matching a Deployment's selector.
+func deploymentPods(kubeContext, namespace, name string) ([]string, error) {
+	output, err := RunKubectl(kubeContext, "get", "deployment", name, "-n", namespace, "-o", "jsonpath={.spec.selector.matchLabels}")
+	if err != nil {
+		return nil, err
+	}
+
+	var labels map[string]string
+	if err := json.Unmarshal([]byte(output), &labels); err != nil {
+		return nil, fmt.Errorf("parse selector of deployment %s: %w", name, err)
+	}
+	if len(labels) == 0 {
+		return nil, nil
+	}
+
+	selector := make([]string, 0, len(labels))
+	for key, value := range labels {
+		selector = append(selector, key+"="+value)
+	}
+	sort.Strings(selector)
+
+	output, err = RunKubectl(kubeContext, "get", "pods", "-n", namespace, "-l", strings.Join(selector, ","), "-o", "name")
+	if err != nil {
+		return nil, err
+	}
+
+	var pods []string
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if pod := strings.TrimPrefix(strings.TrimSpace(line), "pod/"); pod != "" {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
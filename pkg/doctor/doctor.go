@@ -0,0 +1,248 @@
+package doctor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"github.com/yyewolf/kaloupile/pkg/dependencies"
+	"github.com/yyewolf/kaloupile/pkg/kind"
+)
+
+type Check struct {
+	Name   string
+	OK     bool
+	Detail string
+	Hint   string
+}
+
+type tool struct {
+	name       string
+	minVersion string
+	version    func() (string, error)
+	hint       string
+}
+
+var tools = []tool{
+	{
+		name:       "kind",
+		minVersion: "0.20.0",
+		version: func() (string, error) {
+			return dependencies.RunCommand("kind", "version")
+		},
+		hint: "install kind: https://kind.sigs.k8s.io/docs/user/quick-start/#installation",
+	},
+	{
+		name:       "kubectl",
+		minVersion: "1.27.0",
+		version: func() (string, error) {
+			output, err := dependencies.RunCommand("kubectl", "version", "--client", "-o", "json")
+			if err != nil {
+				return "", err
+			}
+			var version struct {
+				ClientVersion struct {
+					GitVersion string `json:"gitVersion"`
+				} `json:"clientVersion"`
+			}
+			if err := json.Unmarshal([]byte(output), &version); err != nil {
+				return "", fmt.Errorf("parse kubectl version: %w", err)
+			}
+			return version.ClientVersion.GitVersion, nil
+		},
+		hint: "install kubectl: https://kubernetes.io/docs/tasks/tools/",
+	},
+	{
+		name: "helm",
+		// OCI chart support (used for kgateway) is stable since 3.8.
+		minVersion: "3.8.0",
+		version: func() (string, error) {
+			return dependencies.RunCommand("helm", "version", "--short")
+		},
+		hint: "install helm: https://helm.sh/docs/intro/install/",
+	},
+	{
+		name:       "docker",
+		minVersion: "20.10.0",
+		version: func() (string, error) {
+			return dependencies.RunCommand("docker", "version", "--format", "{{.Client.Version}}")
+		},
+		hint: "install docker: https://docs.docker.com/engine/install/",
+	},
+}
+
+// Run executes every preflight check and returns their results. cfg does not
+// have to be valid: validation is one of the checks.
+func Run(cfg *config.Config) []Check {
+	checks := []Check{checkConfig(cfg)}
+	for _, t := range tools {
+		checks = append(checks, checkTool(t))
+	}
+	checks = append(checks, checkDockerDaemon())
+	checks = append(checks, checkPorts(cfg)...)
+	return checks
+}
+
+func checkConfig(cfg *config.Config) Check {
+	check := Check{Name: "config"}
+
+	if err := config.Validate(cfg); err != nil {
+		check.Detail = err.Error()
+		check.Hint = "fix the config, `kaloupile config validate` checks it on its own"
+		return check
+	}
+
+	check.OK = true
+	check.Detail = "valid (" + strings.Join(cfg.Files(), ", ") + ")"
+	return check
+}
+
+func checkTool(t tool) Check {
+	check := Check{Name: t.name}
+
+	if _, err := exec.LookPath(t.name); err != nil {
+		check.Detail = "not found in PATH"
+		check.Hint = t.hint
+		return check
+	}
+
+	output, err := t.version()
+	if err != nil {
+		check.Detail = fmt.Sprintf("could not determine version: %v", err)
+		check.Hint = t.hint
+		return check
+	}
+
+	version, ok := parseVersion(output)
+	if !ok {
+		check.Detail = fmt.Sprintf("could not parse version from %q", strings.TrimSpace(output))
+		check.Hint = t.hint
+		return check
+	}
+
+	minimum, _ := parseVersion(t.minVersion)
+	if compareVersions(version, minimum) < 0 {
+		check.Detail = fmt.Sprintf("version %s is older than required %s", formatVersion(version), t.minVersion)
+		check.Hint = fmt.Sprintf("upgrade %s to %s or newer (%s)", t.name, t.minVersion, t.hint)
+		return check
+	}
+
+	check.OK = true
+	check.Detail = fmt.Sprintf("version %s (>= %s)", formatVersion(version), t.minVersion)
+	return check
+}
+
+func checkDockerDaemon() Check {
+	check := Check{Name: "docker daemon"}
+
+	if _, err := exec.LookPath("docker"); err != nil {
+		check.Detail = "docker not found in PATH"
+		check.Hint = "install docker and start the daemon"
+		return check
+	}
+
+	output, err := dependencies.RunCommand("docker", "info", "--format", "{{.ServerVersion}}")
+	if err != nil {
+		check.Detail = "daemon not reachable"
+		check.Hint = "start the docker daemon (e.g. `sudo systemctl start docker`) and make sure your user can access the docker socket"
+		return check
+	}
+
+	check.OK = true
+	check.Detail = "reachable (server " + strings.TrimSpace(output) + ")"
+	return check
+}
+
+func checkPorts(cfg *config.Config) []Check {
+	// A running kaloupile cluster holds its own ports, which is expected.
+	clusterExists, _ := kind.ClusterExists(cfg)
+
+	mappings := dependencies.ClusterPortMappings(cfg)
+	checks := make([]Check, 0, len(mappings))
+	for _, mapping := range mappings {
+		port := cfg.HostPort(mappings, mapping.ContainerPort)
+		check := Check{Name: fmt.Sprintf("host port %d", port)}
+		switch {
+		case clusterExists:
+			check.OK = true
+			check.Detail = "held by kind cluster " + cfg.Cluster.Name
+		case portInUse(port):
+			check.Detail = "already in use"
+			check.Hint = fmt.Sprintf("stop the process listening on port %d (e.g. `sudo lsof -i :%d`) or set cluster.hostPortOffset in the config", port, port)
+		default:
+			check.OK = true
+			check.Detail = "free"
+		}
+		checks = append(checks, check)
+	}
+
+	return checks
+}
+
+func portInUse(port int) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), time.Second)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+var versionPattern = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?`)
+
+func parseVersion(input string) ([3]int, bool) {
+	var version [3]int
+	match := versionPattern.FindStringSubmatch(input)
+	if match == nil {
+		return version, false
+	}
+
+	for i := 0; i < 3; i++ {
+		if match[i+1] == "" {
+			continue
+		}
+		value, err := strconv.Atoi(match[i+1])
+		if err != nil {
+			return version, false
+		}
+		version[i] = value
+	}
+
+	return version, true
+}
+
+func compareVersions(a, b [3]int) int {
+	for i := 0; i < 3; i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func formatVersion(version [3]int) string {
+	return fmt.Sprintf("%d.%d.%d", version[0], version[1], version[2])
+}
+
+// Err returns an error when any of the checks failed.
+func Err(checks []Check) error {
+	failed := 0
+	for _, check := range checks {
+		if !check.OK {
+			failed++
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d preflight checks failed", failed, len(checks))
+}
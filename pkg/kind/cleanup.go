@@ -1,7 +1,16 @@
 package kind
 
-func DeleteCluster() error {
-	return deleteCluster(ClusterName)
+import (
+	"fmt"
+
+	"github.com/yyewolf/kaloupile/pkg/config"
+)
+
+func DeleteCluster(cfg *config.Config) error {
+	if cfg == nil {
+		return fmt.Errorf("config is nil")
+	}
+	return deleteCluster(cfg.Cluster.Name)
 }
 
 func deleteCluster(name string) error {
@@ -0,0 +1,235 @@
+package kind
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"github.com/yyewolf/kaloupile/pkg/dependencies"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ClusterConfigFile = "kind-config.yml"
+	// RegistryHostsDir holds the generated containerd hosts.toml files; it is
+	// mounted into every node at containerdCertsDir.
+	RegistryHostsDir   = "certs.d"
+	containerdCertsDir = "/etc/containerd/certs.d"
+	// ServiceSourceRoot is where service source directories are mounted in
+	// the nodes, one directory per service name.
+	ServiceSourceRoot = "/src"
+)
+
+type clusterConfig struct {
+	Kind                    string       `yaml:"kind"`
+	APIVersion              string       `yaml:"apiVersion"`
+	Name                    string       `yaml:"name"`
+	Nodes                   []nodeConfig `yaml:"nodes"`
+	ContainerdConfigPatches []string     `yaml:"containerdConfigPatches,omitempty"`
+}
+
+type nodeConfig struct {
+	Role              string            `yaml:"role"`
+	Image             string            `yaml:"image,omitempty"`
+	Labels            map[string]string `yaml:"labels,omitempty"`
+	ExtraPortMappings []portMapping     `yaml:"extraPortMappings,omitempty"`
+	ExtraMounts       []mount           `yaml:"extraMounts,omitempty"`
+}
+
+type portMapping struct {
+	ContainerPort int    `yaml:"containerPort"`
+	HostPort      int    `yaml:"hostPort"`
+	Protocol      string `yaml:"protocol"`
+}
+
+type mount struct {
+	HostPath      string `yaml:"hostPath"`
+	ContainerPath string `yaml:"containerPath"`
+	ReadOnly      bool   `yaml:"readOnly,omitempty"`
+}
+
+// RenderClusterConfig renders the kind cluster config: the gateway and
+// dependency port mappings, worker nodes, node image, service source mounts
+// and registry mirrors all come from the config.
+func RenderClusterConfig(cfg *config.Config) ([]byte, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	if cfg.Cluster.Workers < 0 {
+		return nil, fmt.Errorf("cluster.workers must not be negative")
+	}
+
+	mounts, err := nodeMounts(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	controlPlane := nodeConfig{
+		Role:        "control-plane",
+		Image:       cfg.Cluster.NodeImage,
+		Labels:      map[string]string{ManagedLabel: "true"},
+		ExtraMounts: mounts,
+	}
+	for _, mapping := range dependencies.ClusterPortMappings(cfg) {
+		controlPlane.ExtraPortMappings = append(controlPlane.ExtraPortMappings, portMapping{
+			ContainerPort: mapping.ContainerPort,
+			HostPort:      mapping.HostPort + cfg.Cluster.HostPortOffset,
+			Protocol:      mapping.Protocol,
+		})
+	}
+
+	nodes := []nodeConfig{controlPlane}
+	for i := 0; i < cfg.Cluster.Workers; i++ {
+		nodes = append(nodes, nodeConfig{
+			Role:        "worker",
+			Image:       cfg.Cluster.NodeImage,
+			Labels:      map[string]string{ManagedLabel: "true"},
+			ExtraMounts: mounts,
+		})
+	}
+
+	clusterCfg := clusterConfig{
+		Kind:       "Cluster",
+		APIVersion: "kind.x-k8s.io/v1alpha4",
+		Name:       cfg.Cluster.Name,
+		Nodes:      nodes,
+	}
+	if len(cfg.Cluster.RegistryMirrors) > 0 {
+		clusterCfg.ContainerdConfigPatches = []string{
+			fmt.Sprintf("[plugins.\"io.containerd.grpc.v1.cri\".registry]\n  config_path = %q\n", containerdCertsDir),
+		}
+	}
+
+	content, err := yaml.Marshal(clusterCfg)
+	if err != nil {
+		return nil, fmt.Errorf("render kind config: %w", err)
+	}
+
+	return content, nil
+}
+
+func nodeMounts(cfg *config.Config) ([]mount, error) {
+	var mounts []mount
+
+	for _, service := range cfg.Services {
+		if service.Name == "" || service.Path == "" {
+			continue
+		}
+		hostPath, err := filepath.Abs(cfg.ResolvePath(service.Path))
+		if err != nil {
+			return nil, fmt.Errorf("resolve service path %s: %w", service.Path, err)
+		}
+		if _, err := os.Stat(hostPath); err != nil {
+			fmt.Printf("[kind] not mounting service %s: %v\n", service.Name, err)
+			continue
+		}
+		mounts = append(mounts, mount{
+			HostPath:      hostPath,
+			ContainerPath: ServiceSourceRoot + "/" + service.Name,
+		})
+	}
+
+	if len(cfg.Cluster.RegistryMirrors) > 0 {
+		hostsDir, err := filepath.Abs(filepath.Join(cfg.StateDir(), RegistryHostsDir))
+		if err != nil {
+			return nil, fmt.Errorf("resolve registry hosts dir: %w", err)
+		}
+		mounts = append(mounts, mount{
+			HostPath:      hostsDir,
+			ContainerPath: containerdCertsDir,
+			ReadOnly:      true,
+		})
+	}
+
+	return mounts, nil
+}
+
+// renderRegistryHosts renders one containerd hosts.toml per mirrored registry.
+func renderRegistryHosts(cfg *config.Config) map[string][]byte {
+	files := make(map[string][]byte, len(cfg.Cluster.RegistryMirrors))
+
+	registries := make([]string, 0, len(cfg.Cluster.RegistryMirrors))
+	for registry := range cfg.Cluster.RegistryMirrors {
+		registries = append(registries, registry)
+	}
+	sort.Strings(registries)
+
+	for _, registry := range registries {
+		var buf bytes.Buffer
+		for _, endpoint := range cfg.Cluster.RegistryMirrors[registry] {
+			endpoint = strings.TrimSpace(endpoint)
+			if endpoint == "" {
+				continue
+			}
+			fmt.Fprintf(&buf, "[host.%q]\n  capabilities = [\"pull\", \"resolve\"]\n\n", endpoint)
+		}
+		files[filepath.Join(registry, "hosts.toml")] = buf.Bytes()
+	}
+
+	return files
+}
+
+// ClusterConfigPath is where the rendered kind config of the cluster is written.
+func ClusterConfigPath(cfg *config.Config) string {
+	return filepath.Join(cfg.StateDir(), ClusterConfigFile)
+}
+
+// clusterConfigChanged reports whether the config the cluster was created
+// with differs from the one the current config renders.
+func clusterConfigChanged(cfg *config.Config) (bool, error) {
+	current, err := os.ReadFile(ClusterConfigPath(cfg))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("read kind config: %w", err)
+	}
+
+	rendered, err := RenderClusterConfig(cfg)
+	if err != nil {
+		return false, err
+	}
+
+	return !bytes.Equal(current, rendered), nil
+}
+
+func writeClusterConfig(cfg *config.Config) (string, error) {
+	content, err := RenderClusterConfig(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	path, err := filepath.Abs(ClusterConfigPath(cfg))
+	if err != nil {
+		return "", fmt.Errorf("resolve kind config path: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", fmt.Errorf("create kind config dir: %w", err)
+	}
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		return "", fmt.Errorf("write kind config %s: %w", path, err)
+	}
+
+	hostsDir := filepath.Join(cfg.StateDir(), RegistryHostsDir)
+	if err := os.RemoveAll(hostsDir); err != nil {
+		return "", fmt.Errorf("reset registry hosts dir: %w", err)
+	}
+	for name, content := range renderRegistryHosts(cfg) {
+		hostsPath := filepath.Join(hostsDir, name)
+		if err := os.MkdirAll(filepath.Dir(hostsPath), 0o755); err != nil {
+			return "", fmt.Errorf("create registry hosts dir: %w", err)
+		}
+		if err := os.WriteFile(hostsPath, content, 0o644); err != nil {
+			return "", fmt.Errorf("write registry hosts %s: %w", hostsPath, err)
+		}
+	}
+
+	return path, nil
+}
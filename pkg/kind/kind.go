@@ -6,16 +6,32 @@ import (
 	"io"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
-)
 
-const (
-	ClusterName       = "kaloupile-dev"
-	ClusterConfigPath = "kind-config.yml"
+	"github.com/yyewolf/kaloupile/pkg/config"
 )
 
-func EnsureCluster() error {
+// ManagedLabel marks the nodes of clusters created by kaloupile. Only clusters
+// carrying it are ever eligible for deletion by EnsureClusterWith.
+const ManagedLabel = "kaloupile.dev/managed"
+
+type EnsureOptions struct {
+	// Exclusive deletes other kaloupile-managed clusters. Clusters not created
+	// by kaloupile are never deleted.
+	Exclusive bool
+	// Confirm is asked before deleting anything in exclusive mode. Deletion is
+	// skipped when it is nil or returns false.
+	Confirm func(clusters []string) bool
+}
+
+func EnsureCluster(cfg *config.Config) error {
+	return EnsureClusterWith(cfg, EnsureOptions{})
+}
+
+func EnsureClusterWith(cfg *config.Config, opts EnsureOptions) error {
+	if cfg == nil {
+		return fmt.Errorf("config is nil")
+	}
 	if _, err := exec.LookPath("kind"); err != nil {
 		return fmt.Errorf("kind not found in PATH: %w", err)
 	}
@@ -26,25 +42,118 @@ func EnsureCluster() error {
 	}
 
 	hasTarget := false
+	var others []string
 	for _, name := range clusters {
-		if name == ClusterName {
+		if name == cfg.Cluster.Name {
 			hasTarget = true
 			continue
 		}
-		if err := deleteCluster(name); err != nil {
-			return fmt.Errorf("delete kind cluster %s: %w", name, err)
+		others = append(others, name)
+	}
+
+	if opts.Exclusive {
+		if err := deleteManagedClusters(others, opts.Confirm); err != nil {
+			return err
 		}
+	} else if len(others) > 0 {
+		fmt.Printf("[kind] leaving other kind clusters untouched: %s\n", strings.Join(others, ", "))
 	}
 
 	if !hasTarget {
-		if err := createCluster(ClusterName); err != nil {
+		if err := createCluster(cfg); err != nil {
 			return err
 		}
+		return nil
+	}
+
+	changed, err := clusterConfigChanged(cfg)
+	if err != nil {
+		return err
+	}
+	if changed {
+		fmt.Printf("[kind] cluster config changed since %s was created; run cleanup then setup to apply it\n", cfg.Cluster.Name)
+	}
+
+	return nil
+}
+
+func deleteManagedClusters(clusters []string, confirm func([]string) bool) error {
+	if len(clusters) == 0 {
+		return nil
+	}
+
+	var managed []string
+	for _, name := range clusters {
+		ok, err := isManagedCluster(name)
+		switch {
+		case err != nil:
+			fmt.Printf("[kind] keeping %s: could not inspect it: %v\n", name, err)
+		case ok:
+			managed = append(managed, name)
+		default:
+			fmt.Printf("[kind] keeping %s: not created by kaloupile\n", name)
+		}
+	}
+
+	if len(managed) == 0 {
+		return nil
+	}
+
+	fmt.Println("[kind] the following kaloupile clusters would be deleted:")
+	for _, name := range managed {
+		fmt.Printf("[kind]   - %s\n", name)
+	}
+
+	if confirm == nil || !confirm(managed) {
+		fmt.Println("[kind] deletion not confirmed, keeping all clusters")
+		return nil
+	}
+
+	for _, name := range managed {
+		if err := deleteCluster(name); err != nil {
+			return fmt.Errorf("delete kind cluster %s: %w", name, err)
+		}
 	}
 
 	return nil
 }
 
+// isManagedCluster reports whether the cluster nodes carry ManagedLabel.
+func isManagedCluster(name string) (bool, error) {
+	if _, err := exec.LookPath("kubectl"); err != nil {
+		return false, fmt.Errorf("kubectl not found in PATH: %w", err)
+	}
+
+	output, err := runCommandCapture("kubectl", "--context", "kind-"+name, "get", "nodes", "-l", ManagedLabel+"=true", "-o", "name")
+	if err != nil {
+		return false, err
+	}
+
+	return strings.TrimSpace(output) != "", nil
+}
+
+func ClusterExists(cfg *config.Config) (bool, error) {
+	if cfg == nil {
+		return false, fmt.Errorf("config is nil")
+	}
+	if _, err := exec.LookPath("kind"); err != nil {
+		return false, fmt.Errorf("kind not found in PATH: %w", err)
+	}
+
+	clusters, err := listClusters()
+	if err != nil {
+		return false, err
+	}
+
+	for _, name := range clusters {
+		if name == cfg.Cluster.Name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 func listClusters() ([]string, error) {
 	output, err := runKind("get", "clusters")
 	if err != nil {
@@ -64,12 +173,13 @@ func listClusters() ([]string, error) {
 	return clusters, nil
 }
 
-func createCluster(name string) error {
-	configPath, err := filepath.Abs(ClusterConfigPath)
+func createCluster(cfg *config.Config) error {
+	configPath, err := writeClusterConfig(cfg)
 	if err != nil {
-		return fmt.Errorf("resolve kind config path %s: %w", ClusterConfigPath, err)
+		return err
 	}
 
+	name := cfg.Cluster.Name
 	_, err = runKindLogged("create", "cluster", "--name", name, "--config", configPath)
 	if err != nil {
 		return fmt.Errorf("create kind cluster %s: %w", name, err)
@@ -90,7 +200,7 @@ func runCommandCapture(bin string, args ...string) (string, error) {
 	cmd := exec.Command(bin, args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return "", fmt.Errorf("%s %s failed: %w: %s", bin, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+		return "", fmt.Errorf("%s %s failed: %w: %s", bin, config.Redact(strings.Join(args, " ")), err, config.Redact(strings.TrimSpace(string(output))))
 	}
 	return string(output), nil
 }
@@ -100,10 +210,21 @@ func runCommandStreaming(prefix, bin string, args ...string) (string, error) {
 }
 
 func runCommandStreamingWithStdin(prefix, bin string, stdin io.Reader, args ...string) (string, error) {
+	return runCommandStreamingWithStdinEnv(prefix, bin, stdin, nil, args...)
+}
+
+func runCommandStreamingWithEnv(prefix, bin string, env []string, args ...string) (string, error) {
+	return runCommandStreamingWithStdinEnv(prefix, bin, nil, env, args...)
+}
+
+func runCommandStreamingWithStdinEnv(prefix, bin string, stdin io.Reader, env []string, args ...string) (string, error) {
 	cmd := exec.Command(bin, args...)
 	if stdin != nil {
 		cmd.Stdin = stdin
 	}
+	if env != nil {
+		cmd.Env = env
+	}
 
 	var output bytes.Buffer
 	stdoutWriter := newPrefixWriter(prefix, os.Stdout)
@@ -115,7 +236,7 @@ func runCommandStreamingWithStdin(prefix, bin string, stdin io.Reader, args ...s
 	_ = stdoutWriter.Flush()
 	_ = stderrWriter.Flush()
 	if err != nil {
-		return output.String(), fmt.Errorf("%s %s failed: %w: %s", bin, strings.Join(args, " "), err, strings.TrimSpace(output.String()))
+		return output.String(), fmt.Errorf("%s %s failed: %w: %s", bin, config.Redact(strings.Join(args, " ")), err, config.Redact(strings.TrimSpace(output.String())))
 	}
 
 	return output.String(), nil
@@ -139,7 +260,7 @@ func (w *prefixWriter) Write(p []byte) (int, error) {
 	chunk := w.pending + string(p)
 	lines := strings.Split(chunk, "\n")
 	for i := 0; i < len(lines)-1; i++ {
-		if _, err := fmt.Fprintf(w.dst, "[%s] %s\n", w.prefix, lines[i]); err != nil {
+		if _, err := fmt.Fprintf(w.dst, "[%s] %s\n", w.prefix, config.Redact(lines[i])); err != nil {
 			return len(p), err
 		}
 	}
@@ -151,7 +272,7 @@ func (w *prefixWriter) Flush() error {
 	if w.pending == "" {
 		return nil
 	}
-	_, err := fmt.Fprintf(w.dst, "[%s] %s\n", w.prefix, w.pending)
+	_, err := fmt.Fprintf(w.dst, "[%s] %s\n", w.prefix, config.Redact(w.pending))
 	w.pending = ""
 	return err
 }
@@ -2,21 +2,35 @@ package kind
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+
+	"github.com/yyewolf/kaloupile/pkg/config"
 )
 
 const DefaultPrerequisitesScript = "cluster/prerequisites/install-prerequisites.sh"
 
-func InstallPrerequisites() error {
-	return InstallPrerequisitesFrom(DefaultPrerequisitesScript)
+func InstallPrerequisites(cfg *config.Config) error {
+	return InstallPrerequisitesFrom(cfg, DefaultPrerequisitesScript)
 }
 
-func InstallPrerequisitesFrom(path string) error {
+func InstallPrerequisitesFrom(cfg *config.Config, path string) error {
+	if cfg == nil {
+		return fmt.Errorf("config is nil")
+	}
+
 	absPath, err := filepath.Abs(path)
 	if err != nil {
 		return fmt.Errorf("resolve prerequisites path %s: %w", path, err)
 	}
 
-	_, err = runCommandStreaming("prerequisites", "bash", absPath)
+	// The script targets the cluster context explicitly through these
+	// variables instead of relying on the current kubeconfig context.
+	env := append(os.Environ(),
+		"KUBE_CONTEXT="+cfg.KubeContext(),
+		"HELM_KUBECONTEXT="+cfg.KubeContext(),
+	)
+
+	_, err = runCommandStreamingWithEnv("prerequisites", "bash", env, absPath)
 	return err
 }
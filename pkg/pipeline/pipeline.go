@@ -0,0 +1,210 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Step is a single node of the pipeline graph. Inputs lists the files and
+// directories whose content decides whether the step needs to run again;
+// Fingerprint covers inputs that are not files. Always steps run every time,
+// for state that can be lost without any input changing. Exists, when set,
+// checks that what the step produced is still there before its unchanged
+// inputs are trusted, e.g. a cluster deleted by hand.
+type Step struct {
+	Name        string
+	DependsOn   []string
+	Inputs      []string
+	Fingerprint string
+	Always      bool
+	Exists      func() (bool, error)
+	Run         func() error
+}
+
+// Runner wraps the execution of a step, e.g. to add logging.
+type Runner func(name string, fn func() error) error
+
+type Options struct {
+	// Force runs every step regardless of recorded state.
+	Force bool
+	// From forces the named step and everything depending on it to run.
+	From string
+	// OnSkip is called for every step skipped because its inputs are unchanged.
+	OnSkip func(name string)
+}
+
+type Pipeline struct {
+	steps     []Step
+	statePath string
+}
+
+func New(statePath string, steps ...Step) (*Pipeline, error) {
+	ordered, err := sortSteps(steps)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pipeline{steps: ordered, statePath: statePath}, nil
+}
+
+// Steps returns the step names in execution order.
+func (p *Pipeline) Steps() []string {
+	names := make([]string, 0, len(p.steps))
+	for _, step := range p.steps {
+		names = append(names, step.Name)
+	}
+	return names
+}
+
+func (p *Pipeline) Run(run Runner, opts Options) error {
+	if opts.From != "" && !p.has(opts.From) {
+		return fmt.Errorf("unknown step %q (known: %s)", opts.From, strings.Join(p.Steps(), ", "))
+	}
+
+	state, err := loadState(p.statePath)
+	if err != nil {
+		return err
+	}
+
+	ran := make(map[string]bool)
+	for _, step := range p.steps {
+		hash, err := hashInputs(step.Inputs, step.Fingerprint)
+		if err != nil {
+			return fmt.Errorf("hash inputs of %s: %w", step.Name, err)
+		}
+
+		mustRun, err := p.mustRun(step, hash, state, ran, opts)
+		if err != nil {
+			return fmt.Errorf("check %s: %w", step.Name, err)
+		}
+		if !mustRun {
+			if opts.OnSkip != nil {
+				opts.OnSkip(step.Name)
+			}
+			continue
+		}
+
+		delete(state.Steps, step.Name)
+		state.Failed = ""
+		if err := run(step.Name, step.Run); err != nil {
+			state.Failed = step.Name
+			if saveErr := saveState(p.statePath, state); saveErr != nil {
+				return fmt.Errorf("%w (save state: %v)", err, saveErr)
+			}
+			return err
+		}
+
+		ran[step.Name] = true
+		state.Steps[step.Name] = hash
+		if err := saveState(p.statePath, state); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FailedStep returns the step that failed during the last run, if any.
+func (p *Pipeline) FailedStep() (string, error) {
+	state, err := loadState(p.statePath)
+	if err != nil {
+		return "", err
+	}
+	return state.Failed, nil
+}
+
+func (p *Pipeline) mustRun(step Step, hash string, state *state, ran map[string]bool, opts Options) (bool, error) {
+	if opts.Force || step.Always || step.Name == opts.From {
+		return true, nil
+	}
+
+	for _, dep := range step.DependsOn {
+		if ran[dep] {
+			return true, nil
+		}
+	}
+
+	recorded, ok := state.Steps[step.Name]
+	if !ok || recorded != hash {
+		return true, nil
+	}
+	if step.Exists != nil {
+		exists, err := step.Exists()
+		return !exists, err
+	}
+	return false, nil
+}
+
+func (p *Pipeline) has(name string) bool {
+	for _, step := range p.steps {
+		if step.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sortSteps orders steps so every step comes after its dependencies, keeping
+// the declaration order between independent steps.
+func sortSteps(steps []Step) ([]Step, error) {
+	index := make(map[string]int, len(steps))
+	for i, step := range steps {
+		if step.Name == "" {
+			return nil, fmt.Errorf("step %d has no name", i)
+		}
+		if step.Run == nil {
+			return nil, fmt.Errorf("step %s has no run function", step.Name)
+		}
+		if _, exists := index[step.Name]; exists {
+			return nil, fmt.Errorf("duplicate step %s", step.Name)
+		}
+		index[step.Name] = i
+	}
+
+	for _, step := range steps {
+		for _, dep := range step.DependsOn {
+			if _, ok := index[dep]; !ok {
+				return nil, fmt.Errorf("step %s depends on unknown step %s", step.Name, dep)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make([]int, len(steps))
+	ordered := make([]Step, 0, len(steps))
+
+	var visit func(i int, path []string) error
+	visit = func(i int, path []string) error {
+		switch marks[i] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s", strings.Join(append(path, steps[i].Name), " -> "))
+		}
+
+		marks[i] = visiting
+		deps := append([]string(nil), steps[i].DependsOn...)
+		sort.SliceStable(deps, func(a, b int) bool { return index[deps[a]] < index[deps[b]] })
+		for _, dep := range deps {
+			if err := visit(index[dep], append(path, steps[i].Name)); err != nil {
+				return err
+			}
+		}
+		marks[i] = visited
+		ordered = append(ordered, steps[i])
+		return nil
+	}
+
+	for i := range steps {
+		if err := visit(i, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return ordered, nil
+}
@@ -0,0 +1,49 @@
+package pipeline
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRunRerunsStepWhoseOutputIsGone(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), StateFile)
+	exists := true
+	var ran []string
+
+	newPipeline := func() *Pipeline {
+		step := func(name string) func() error {
+			return func() error {
+				ran = append(ran, name)
+				return nil
+			}
+		}
+		p, err := New(statePath,
+			Step{Name: "cluster", Fingerprint: "kind config", Exists: func() (bool, error) { return exists, nil }, Run: step("cluster")},
+			Step{Name: "dependencies", DependsOn: []string{"cluster"}, Fingerprint: "deps", Run: step("dependencies")},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	run := func(name string, fn func() error) error { return fn() }
+
+	for _, tc := range []struct {
+		name   string
+		exists bool
+		want   []string
+	}{
+		{"first run", true, []string{"cluster", "dependencies"}},
+		{"unchanged", true, nil},
+		{"cluster deleted", false, []string{"cluster", "dependencies"}},
+	} {
+		exists, ran = tc.exists, nil
+		if err := newPipeline().Run(run, Options{}); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !slices.Equal(ran, tc.want) {
+			t.Fatalf("%s: ran %v, want %v", tc.name, ran, tc.want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const StateFile = "state.json"
+
+type state struct {
+	Steps  map[string]string `json:"steps"`
+	Failed string            `json:"failed,omitempty"`
+}
+
+func loadState(path string) (*state, error) {
+	st := &state{Steps: make(map[string]string)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return st, nil
+		}
+		return nil, fmt.Errorf("read pipeline state %s: %w", path, err)
+	}
+
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("parse pipeline state %s: %w", path, err)
+	}
+	if st.Steps == nil {
+		st.Steps = make(map[string]string)
+	}
+
+	return st, nil
+}
+
+func saveState(path string, st *state) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("create pipeline state dir: %w", err)
+	}
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode pipeline state: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("write pipeline state %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// ResetState forgets every recorded step so the next run starts from scratch.
+func ResetState(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove pipeline state %s: %w", path, err)
+	}
+	return nil
+}
+
+// hashInputs hashes the fingerprint and the content of every file below the
+// given paths. Missing paths are hashed as absent so creating them later
+// invalidates the step.
+func hashInputs(paths []string, fingerprint string) (string, error) {
+	hasher := sha256.New()
+	fmt.Fprintf(hasher, "fingerprint %s\n", fingerprint)
+
+	for _, root := range paths {
+		files, err := listFiles(root)
+		if err != nil {
+			return "", err
+		}
+
+		if len(files) == 0 {
+			fmt.Fprintf(hasher, "missing %s\n", root)
+			continue
+		}
+
+		for _, file := range files {
+			fmt.Fprintf(hasher, "file %s\n", filepath.ToSlash(file))
+			if err := hashFile(hasher, file); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func listFiles(root string) ([]string, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return []string{root}, nil
+	}
+
+	var files []string
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+func hashFile(dst io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(dst, file)
+	return err
+}
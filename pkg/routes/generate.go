@@ -2,6 +2,7 @@ package routes
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -11,6 +12,7 @@ import (
 	"text/template"
 
 	"github.com/yyewolf/kaloupile/pkg/config"
+	"gopkg.in/yaml.v3"
 )
 
 const RoutesTemplatePath = "cluster/routes/routes.yaml"
@@ -32,10 +34,81 @@ func InstallRoutesFrom(cfg *config.Config, templatePath string) error {
 		return err
 	}
 
-	_, err = runCommandStreaming("kubectl", "kubectl", bytes.NewReader(rendered), "apply", "-f", "-")
+	_, err = runCommandStreaming("kubectl", "kubectl", bytes.NewReader(rendered), "--context", cfg.KubeContext(), "apply", "-f", "-")
 	return err
 }
 
+type Route struct {
+	Name      string
+	Namespace string
+	Parents   []RouteParent
+}
+
+type RouteParent struct {
+	Name      string
+	Namespace string
+}
+
+// ListRoutes renders the routes template and returns the HTTPRoutes it declares.
+func ListRoutes(cfg *config.Config) ([]Route, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+
+	rendered, err := renderRoutesTemplate(RoutesTemplatePath, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseRoutes(rendered)
+}
+
+func parseRoutes(content []byte) ([]Route, error) {
+	type manifest struct {
+		Kind     string `yaml:"kind"`
+		Metadata struct {
+			Name      string `yaml:"name"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"metadata"`
+		Spec struct {
+			ParentRefs []struct {
+				Name      string `yaml:"name"`
+				Namespace string `yaml:"namespace"`
+			} `yaml:"parentRefs"`
+		} `yaml:"spec"`
+	}
+
+	var routes []Route
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var doc manifest
+		if err := decoder.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("parse routes manifest: %w", err)
+		}
+		if doc.Kind != "HTTPRoute" {
+			continue
+		}
+
+		route := Route{Name: doc.Metadata.Name, Namespace: doc.Metadata.Namespace}
+		if route.Namespace == "" {
+			route.Namespace = "default"
+		}
+		for _, ref := range doc.Spec.ParentRefs {
+			parent := RouteParent{Name: ref.Name, Namespace: ref.Namespace}
+			if parent.Namespace == "" {
+				parent.Namespace = route.Namespace
+			}
+			route.Parents = append(route.Parents, parent)
+		}
+		routes = append(routes, route)
+	}
+
+	return routes, nil
+}
+
 func renderRoutesTemplate(path string, data any) ([]byte, error) {
 	absPath, err := filepath.Abs(path)
 	if err != nil {
@@ -76,7 +149,7 @@ func runCommandStreaming(prefix, bin string, stdin io.Reader, args ...string) (s
 	_ = stdoutWriter.Flush()
 	_ = stderrWriter.Flush()
 	if err != nil {
-		return output.String(), fmt.Errorf("%s %s failed: %w: %s", bin, strings.Join(args, " "), err, strings.TrimSpace(output.String()))
+		return output.String(), fmt.Errorf("%s %s failed: %w: %s", bin, config.Redact(strings.Join(args, " ")), err, config.Redact(strings.TrimSpace(output.String())))
 	}
 
 	return output.String(), nil
@@ -100,7 +173,7 @@ func (w *prefixWriter) Write(p []byte) (int, error) {
 	chunk := w.pending + string(p)
 	lines := strings.Split(chunk, "\n")
 	for i := 0; i < len(lines)-1; i++ {
-		if _, err := fmt.Fprintf(w.dst, "[%s] %s\n", w.prefix, lines[i]); err != nil {
+		if _, err := fmt.Fprintf(w.dst, "[%s] %s\n", w.prefix, config.Redact(lines[i])); err != nil {
 			return len(p), err
 		}
 	}
@@ -112,7 +185,7 @@ func (w *prefixWriter) Flush() error {
 	if w.pending == "" {
 		return nil
 	}
-	_, err := fmt.Fprintf(w.dst, "[%s] %s\n", w.prefix, w.pending)
+	_, err := fmt.Fprintf(w.dst, "[%s] %s\n", w.prefix, config.Redact(w.pending))
 	w.pending = ""
 	return err
 }
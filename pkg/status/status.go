@@ -0,0 +1,207 @@
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"github.com/yyewolf/kaloupile/pkg/dependencies"
+	postgresdep "github.com/yyewolf/kaloupile/pkg/dependencies/postgresql"
+	redisdep "github.com/yyewolf/kaloupile/pkg/dependencies/redis"
+	"github.com/yyewolf/kaloupile/pkg/kind"
+	"github.com/yyewolf/kaloupile/pkg/routes"
+	"github.com/yyewolf/kaloupile/pkg/sync"
+)
+
+const (
+	GatewayName      = dependencies.GatewayName
+	GatewayNamespace = dependencies.GatewayNamespace
+)
+
+type Check struct {
+	Component string `json:"component"`
+	Name      string `json:"name"`
+	Healthy   bool   `json:"healthy"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+type Report struct {
+	Healthy bool    `json:"healthy"`
+	Checks  []Check `json:"checks"`
+}
+
+func (r *Report) add(check Check) {
+	r.Checks = append(r.Checks, check)
+	if !check.Healthy {
+		r.Healthy = false
+	}
+}
+
+// Unhealthy returns the number of failed checks.
+func (r *Report) Unhealthy() int {
+	count := 0
+	for _, check := range r.Checks {
+		if !check.Healthy {
+			count++
+		}
+	}
+	return count
+}
+
+// Collect checks the cluster, dependencies, routes and sync targets. Failures
+// are reported as unhealthy checks rather than errors so that every component
+// is always listed.
+func Collect(cfg *config.Config) (*Report, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+
+	report := &Report{Healthy: true}
+
+	clusterUp := checkCluster(report, cfg)
+	if clusterUp {
+		if _, err := exec.LookPath("kubectl"); err != nil {
+			report.add(Check{Component: "kubectl", Name: "kubectl", Detail: fmt.Sprintf("kubectl not found in PATH: %v", err)})
+			clusterUp = false
+		}
+	}
+
+	checkDependencies(report, cfg, clusterUp)
+	checkRoutes(report, cfg, clusterUp)
+	if dependencies.IsEnabledByName(cfg, postgresdep.Name) {
+		statuses, err := sync.PostgreSQLStatus(cfg)
+		checkSync(report, "postgresql", statuses, err)
+	}
+	if dependencies.IsEnabledByName(cfg, redisdep.Name) {
+		statuses, err := sync.RedisStatus(cfg)
+		checkSync(report, "redis", statuses, err)
+	}
+	if len(cfg.S3.Buckets) > 0 {
+		statuses, err := sync.S3Status(cfg)
+		checkSync(report, "s3", statuses, err)
+	}
+
+	return report, nil
+}
+
+func checkCluster(report *Report, cfg *config.Config) bool {
+	name := cfg.Cluster.Name
+	exists, err := kind.ClusterExists(cfg)
+	switch {
+	case err != nil:
+		report.add(Check{Component: "cluster", Name: name, Detail: err.Error()})
+	case !exists:
+		report.add(Check{Component: "cluster", Name: name, Detail: "kind cluster not found"})
+	default:
+		report.add(Check{Component: "cluster", Name: name, Healthy: true, Detail: "exists"})
+	}
+	return err == nil && exists
+}
+
+func checkDependencies(report *Report, cfg *config.Config, clusterUp bool) {
+	for _, dep := range dependencies.Enabled(cfg) {
+		check := Check{Component: "dependency", Name: dep.Name()}
+		if !clusterUp {
+			check.Detail = "cluster unavailable"
+			report.add(check)
+			continue
+		}
+
+		ready, detail, err := dep.Ready(cfg)
+		if err != nil {
+			detail = err.Error()
+		}
+		check.Healthy, check.Detail = ready, detail
+		report.add(check)
+	}
+}
+
+func checkRoutes(report *Report, cfg *config.Config, clusterUp bool) {
+	declared, err := routes.ListRoutes(cfg)
+	if err != nil {
+		report.add(Check{Component: "route", Name: routes.RoutesTemplatePath, Detail: err.Error()})
+		return
+	}
+
+	for _, route := range declared {
+		check := Check{Component: "route", Name: route.Namespace + "/" + route.Name}
+		if !clusterUp {
+			check.Detail = "cluster unavailable"
+			report.add(check)
+			continue
+		}
+
+		check.Healthy, check.Detail = routeAccepted(cfg.KubeContext(), route)
+		report.add(check)
+	}
+}
+
+func routeAccepted(kubeContext string, route routes.Route) (bool, string) {
+	output, err := dependencies.RunKubectl(kubeContext, "get", "httproute", route.Name, "-n", route.Namespace, "-o", "json")
+	if err != nil {
+		if dependencies.IsNotFound(err) {
+			return false, "httproute not found"
+		}
+		return false, err.Error()
+	}
+
+	var httpRoute struct {
+		Status struct {
+			Parents []struct {
+				ParentRef struct {
+					Name      string `json:"name"`
+					Namespace string `json:"namespace"`
+				} `json:"parentRef"`
+				Conditions []struct {
+					Type    string `json:"type"`
+					Status  string `json:"status"`
+					Message string `json:"message"`
+				} `json:"conditions"`
+			} `json:"parents"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal([]byte(output), &httpRoute); err != nil {
+		return false, fmt.Sprintf("parse httproute: %v", err)
+	}
+
+	for _, parent := range httpRoute.Status.Parents {
+		namespace := parent.ParentRef.Namespace
+		if namespace == "" {
+			namespace = route.Namespace
+		}
+		if parent.ParentRef.Name != GatewayName || namespace != GatewayNamespace {
+			continue
+		}
+
+		for _, condition := range parent.Conditions {
+			if condition.Type != "Accepted" {
+				continue
+			}
+			if condition.Status == "True" {
+				return true, "accepted by " + GatewayName
+			}
+			return false, fmt.Sprintf("not accepted by %s: %s", GatewayName, condition.Message)
+		}
+	}
+
+	return false, "no status from " + GatewayName
+}
+
+// checkSync reports one check per object a sync target manages.
+func checkSync(report *Report, target string, statuses []sync.ObjectStatus, err error) {
+	if err != nil {
+		report.add(Check{Component: "sync", Name: target, Detail: err.Error()})
+		return
+	}
+
+	for _, object := range statuses {
+		check := Check{Component: "sync", Name: target + " " + object.Kind + " " + object.Name, Healthy: object.Exists}
+		if object.Exists {
+			check.Detail = "exists"
+		} else {
+			check.Detail = "missing"
+		}
+		report.add(check)
+	}
+}
@@ -0,0 +1,16 @@
+package sync
+
+import "time"
+
+// Options tunes a sync run; the zero value syncs once without retries.
+type Options struct {
+	// RetryTimeout bounds how long transient failures (server not reachable
+	// yet, starting up, restarting) are retried. Zero disables retries.
+	RetryTimeout time.Duration
+	// Prune drops the roles and databases created by kaloupile that are no
+	// longer in config.
+	Prune bool
+	// ConfirmPrune is asked before dropping anything. Pruning is skipped when
+	// it is nil or returns false.
+	ConfirmPrune func(objects []PruneObject) bool
+}
@@ -0,0 +1,596 @@
+package sync
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/yyewolf/kaloupile/pkg/config"
+	postgresdep "github.com/yyewolf/kaloupile/pkg/dependencies/postgresql"
+)
+
+// Statement is one SQL statement of a PostgreSQL sync plan.
+type Statement struct {
+	// Database is where the statement runs; empty means the admin database.
+	Database    string
+	SQL         string
+	Description string
+	// Secret is a value quoted in SQL, such as a password, that WritePlan
+	// masks.
+	Secret string
+}
+
+// WritePlan prints statements as a psql script, switching databases with
+// \connect. Passwords and secrets are redacted, so they have to be filled
+// in before the script is run.
+func WritePlan(w io.Writer, cfg *config.Config, statements []Statement) error {
+	current := ""
+	for _, statement := range statements {
+		database := statement.Database
+		if database == "" {
+			database = cfg.Postgres.Admin.Database
+		}
+		if database != current {
+			if _, err := fmt.Fprintf(w, "\\connect %s\n", pq.QuoteIdentifier(database)); err != nil {
+				return err
+			}
+			current = database
+		}
+		sql := statement.SQL
+		if statement.Secret != "" {
+			sql = strings.ReplaceAll(sql, pq.QuoteLiteral(statement.Secret), "'[redacted]'")
+		}
+		if _, err := fmt.Fprintf(w, "-- %s\n%s;\n", statement.Description, config.Redact(sql)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// planPostgreSQL compares cfg.Postgres.Users with pg_roles, pg_database,
+// pg_extension, pg_namespace and the current grants and returns the
+// statements that reconcile them: roles first, then databases with their
+// extensions and schemas, then grants.
+func planPostgreSQL(cfg *config.Config, conns *pgConnections) ([]Statement, error) {
+	adminDB, err := conns.admin()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &planner{cfg: cfg, conns: conns, adminDB: adminDB, newRoles: make(map[string]bool), newDatabases: make(map[string]bool)}
+	for _, user := range cfg.Postgres.Users {
+		if err := p.planRole(user); err != nil {
+			return nil, err
+		}
+	}
+	specs := databaseSpecs(cfg)
+	for _, spec := range specs {
+		if err := p.planDatabase(spec); err != nil {
+			return nil, err
+		}
+	}
+	for _, user := range cfg.Postgres.Users {
+		for _, database := range user.Databases {
+			i := slices.IndexFunc(specs, func(spec databaseSpec) bool { return spec.name == database.Name })
+			if err := p.planGrants(user, database, specs[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return p.plan, nil
+}
+
+type planner struct {
+	cfg     *config.Config
+	conns   *pgConnections
+	adminDB *sql.DB
+	plan    []Statement
+	// newRoles and newDatabases are created by the plan itself, so there is
+	// nothing to inspect in them yet.
+	newRoles     map[string]bool
+	newDatabases map[string]bool
+}
+
+func (p *planner) add(database, description, query string, args ...any) {
+	p.plan = append(p.plan, Statement{Database: database, Description: description, SQL: fmt.Sprintf(query, args...)})
+}
+
+// addSecret is add for a statement quoting secret.
+func (p *planner) addSecret(secret, database, description, query string, args ...any) {
+	p.add(database, description, query, args...)
+	p.plan[len(p.plan)-1].Secret = secret
+}
+
+func (p *planner) planRole(user config.PostgresUser) error {
+	role := pq.QuoteIdentifier(user.Name)
+	wanted := wantedRoleAttributes(user.Attributes)
+
+	exists, err := userExists(p.adminDB, user.Name)
+	if err != nil {
+		return fmt.Errorf("check user %s: %w", user.Name, err)
+	}
+	if !exists {
+		p.newRoles[user.Name] = true
+		p.addSecret(user.Password, "", "create user "+user.Name, "CREATE USER %s WITH PASSWORD %s%s", role, pq.QuoteLiteral(user.Password), attributeClause(wanted, nil))
+		p.add("", "mark user "+user.Name, "COMMENT ON ROLE %s IS %s", role, pq.QuoteLiteral(ManagedMarker))
+		return nil
+	}
+
+	matches, err := passwordMatches(p.adminDB, user.Name, user.Password)
+	if err != nil {
+		return fmt.Errorf("check password of %s: %w", user.Name, err)
+	}
+	if !matches {
+		p.addSecret(user.Password, "", "update password of "+user.Name, "ALTER USER %s WITH PASSWORD %s", role, pq.QuoteLiteral(user.Password))
+	}
+
+	current, err := currentRoleAttributes(p.adminDB, user.Name)
+	if err != nil {
+		return fmt.Errorf("check attributes of %s: %w", user.Name, err)
+	}
+	if clause := attributeClause(wanted, current); clause != "" {
+		p.add("", "update attributes of "+user.Name, "ALTER ROLE %s WITH%s", role, clause)
+	}
+	return nil
+}
+
+func (p *planner) planDatabase(spec databaseSpec) error {
+	database := pq.QuoteIdentifier(spec.name)
+
+	exists, err := databaseExists(p.adminDB, spec.name)
+	if err != nil {
+		return fmt.Errorf("check database %s: %w", spec.name, err)
+	}
+
+	var targetDB *sql.DB
+	switch {
+	case !exists:
+		p.newDatabases[spec.name] = true
+		owner := ""
+		if spec.owner != "" {
+			owner = " OWNER " + pq.QuoteIdentifier(spec.owner)
+		}
+		p.add("", "create database "+spec.name, "CREATE DATABASE %s%s", database, owner)
+		p.add("", "mark database "+spec.name, "COMMENT ON DATABASE %s IS %s", database, pq.QuoteLiteral(ManagedMarker))
+	default:
+		if spec.owner != "" {
+			var current string
+			if err := p.adminDB.QueryRow("SELECT pg_get_userbyid(datdba) FROM pg_database WHERE datname = $1", spec.name).Scan(&current); err != nil {
+				return fmt.Errorf("check owner of database %s: %w", spec.name, err)
+			}
+			if current != spec.owner {
+				p.add("", "change owner of database "+spec.name, "ALTER DATABASE %s OWNER TO %s", database, pq.QuoteIdentifier(spec.owner))
+			}
+		}
+		targetDB, err = p.conns.db(spec.name)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, extension := range spec.extensions {
+		if targetDB != nil {
+			found, err := rowExists(targetDB, "SELECT 1 FROM pg_extension WHERE extname = $1", extension)
+			if err != nil {
+				return fmt.Errorf("check extension %s on %s: %w", extension, spec.name, err)
+			}
+			if found {
+				continue
+			}
+		}
+		p.add(spec.name, "create extension "+extension, "CREATE EXTENSION IF NOT EXISTS %s", pq.QuoteIdentifier(extension))
+	}
+
+	for _, schema := range spec.schemas {
+		if targetDB != nil {
+			found, err := rowExists(targetDB, "SELECT 1 FROM pg_namespace WHERE nspname = $1", schema)
+			if err != nil {
+				return fmt.Errorf("check schema %s on %s: %w", schema, spec.name, err)
+			}
+			if found {
+				continue
+			}
+		}
+		authorization := ""
+		if spec.owner != "" {
+			authorization = " AUTHORIZATION " + pq.QuoteIdentifier(spec.owner)
+		}
+		p.add(spec.name, "create schema "+schema, "CREATE SCHEMA IF NOT EXISTS %s%s", pq.QuoteIdentifier(schema), authorization)
+	}
+
+	return nil
+}
+
+// planGrants brings the privileges of user on database to its profile: the
+// database itself, then public and the database schemas with their existing
+// tables and sequences and the default privileges for future ones. Missing
+// privileges are granted and privileges beyond the profile revoked.
+func (p *planner) planGrants(user config.PostgresUser, database config.PostgresDatabase, spec databaseSpec) error {
+	profile, ok := p.cfg.PostgresProfile(database.Profile)
+	if !ok {
+		return permanent(fmt.Errorf("unknown privilege profile %q for %s on %s", database.Profile, user.Name, database.Name))
+	}
+	dbName := database.Name
+	target := grantTarget{role: user.Name}
+
+	// A database created by the plan has nothing to inspect yet. In an
+	// existing one, a role created by the plan holds no grants, but the
+	// existing tables and sequences still have to be granted to it.
+	var targetDB *sql.DB
+	if !p.newDatabases[dbName] {
+		var err error
+		targetDB, err = p.conns.db(dbName)
+		if err != nil {
+			return err
+		}
+	}
+
+	// grantsDB and adminDB read the current grants, nil when they are known
+	// to be empty.
+	grantsDB, adminDB := targetDB, p.adminDB
+	if targetDB == nil || p.newRoles[user.Name] {
+		grantsDB, adminDB = nil, nil
+	}
+	if err := p.reconcile(adminDB, "", target.on("DATABASE "+pq.QuoteIdentifier(dbName)), "database "+dbName, profile.Database, config.PostgresDatabasePrivileges,
+		databaseGrantsQuery, dbName, user.Name); err != nil {
+		return err
+	}
+
+	// Default privileges only apply to objects created by the role they are
+	// set for: the admin user, and the database owner the application
+	// usually migrates with.
+	creators := []string{p.cfg.Postgres.Admin.User}
+	if spec.owner != "" && spec.owner != p.cfg.Postgres.Admin.User {
+		creators = append(creators, spec.owner)
+	}
+
+	for _, schemaName := range append([]string{"public"}, database.Schemas...) {
+		schema := pq.QuoteIdentifier(schemaName)
+		if err := p.reconcile(grantsDB, dbName, target.on("SCHEMA "+schema), "schema "+schemaName, profile.Schema, config.PostgresSchemaPrivileges,
+			schemaGrantsQuery, schemaName, user.Name); err != nil {
+			return err
+		}
+
+		if targetDB != nil {
+			if err := p.reconcileRelations(targetDB, dbName, target.on("ALL TABLES IN SCHEMA "+schema), "tables in "+schemaName, profile.Tables, config.PostgresTablePrivileges,
+				schemaName, tableKinds, user.Name); err != nil {
+				return err
+			}
+			if err := p.reconcileRelations(targetDB, dbName, target.on("ALL SEQUENCES IN SCHEMA "+schema), "sequences in "+schemaName, profile.Sequences, config.PostgresSequencePrivileges,
+				schemaName, sequenceKinds, user.Name); err != nil {
+				return err
+			}
+		}
+
+		for _, creator := range creators {
+			if creator == user.Name {
+				continue
+			}
+			defaults := grantTarget{role: user.Name, prefix: fmt.Sprintf("ALTER DEFAULT PRIVILEGES FOR ROLE %s IN SCHEMA %s ", pq.QuoteIdentifier(creator), schema)}
+			if err := p.reconcile(grantsDB, dbName, defaults.on("TABLES"), "default privileges on tables in "+schemaName+" created by "+creator, profile.Tables, config.PostgresTablePrivileges,
+				defaultGrantsQuery, schemaName, "r", user.Name, creator); err != nil {
+				return err
+			}
+			if err := p.reconcile(grantsDB, dbName, defaults.on("SEQUENCES"), "default privileges on sequences in "+schemaName+" created by "+creator, profile.Sequences, config.PostgresSequencePrivileges,
+				defaultGrantsQuery, schemaName, "S", user.Name, creator); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// grantTarget builds the GRANT and REVOKE statements for one object.
+type grantTarget struct {
+	role   string
+	prefix string
+	object string
+}
+
+func (t grantTarget) on(object string) grantTarget {
+	t.object = object
+	return t
+}
+
+func (t grantTarget) grant(privileges []string) string {
+	return fmt.Sprintf("%sGRANT %s ON %s TO %s", t.prefix, strings.Join(privileges, ", "), t.object, pq.QuoteIdentifier(t.role))
+}
+
+func (t grantTarget) revoke(privileges []string) string {
+	return fmt.Sprintf("%sREVOKE %s ON %s FROM %s", t.prefix, strings.Join(privileges, ", "), t.object, pq.QuoteIdentifier(t.role))
+}
+
+// reconcile plans the grants and revokes turning the privileges query
+// returns into wanted. A nil db means the object is created by the plan, so
+// everything wanted is granted.
+func (p *planner) reconcile(db *sql.DB, database string, target grantTarget, what string, wanted, known []string, query string, args ...any) error {
+	var granted map[string]bool
+	if db != nil {
+		var err error
+		granted, err = grantedPrivileges(db, query, args...)
+		if err != nil {
+			return fmt.Errorf("check privileges of %s on %s: %w", target.role, what, err)
+		}
+	}
+	p.planDiff(database, target, what, wanted, known, func(privilege string) (bool, bool) {
+		return granted[privilege], granted[privilege]
+	})
+	return nil
+}
+
+// reconcileRelations is reconcile for every existing table or sequence of a
+// schema at once: a privilege is missing when any relation lacks it and in
+// excess when any relation has it. Relations owned by the role are skipped.
+func (p *planner) reconcileRelations(db *sql.DB, database string, target grantTarget, what string, wanted, known []string, schema string, kinds []string, role string) error {
+	rows, err := db.Query(relationGrantsQuery, schema, pq.Array(kinds), role)
+	if err != nil {
+		return fmt.Errorf("check privileges of %s on %s: %w", role, what, err)
+	}
+	defer rows.Close()
+
+	granted := make(map[string]map[string]bool)
+	for rows.Next() {
+		var relation, privilege string
+		if err := rows.Scan(&relation, &privilege); err != nil {
+			return fmt.Errorf("check privileges of %s on %s: %w", role, what, err)
+		}
+		if granted[relation] == nil {
+			granted[relation] = make(map[string]bool)
+		}
+		if privilege != "" {
+			granted[relation][privilege] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("check privileges of %s on %s: %w", role, what, err)
+	}
+	if len(granted) == 0 {
+		return nil
+	}
+
+	p.planDiff(database, target, what, wanted, known, func(privilege string) (onAll, onAny bool) {
+		onAll = true
+		for _, privileges := range granted {
+			onAll = onAll && privileges[privilege]
+			onAny = onAny || privileges[privilege]
+		}
+		return onAll, onAny
+	})
+	return nil
+}
+
+// planDiff adds a GRANT for the wanted privileges not held everywhere and a
+// REVOKE for the known privileges held anywhere but not wanted. Privileges
+// outside known, such as MAINTAIN, are left alone.
+func (p *planner) planDiff(database string, target grantTarget, what string, wanted, known []string, held func(privilege string) (onAll, onAny bool)) {
+	var missing, excess []string
+	for _, privilege := range known {
+		onAll, onAny := held(privilege)
+		switch {
+		case slices.Contains(wanted, privilege) && !onAll:
+			missing = append(missing, privilege)
+		case !slices.Contains(wanted, privilege) && onAny:
+			excess = append(excess, privilege)
+		}
+	}
+	if len(missing) > 0 {
+		p.add(database, "grant "+strings.ToLower(strings.Join(missing, ", "))+" on "+what+" to "+target.role, "%s", target.grant(missing))
+	}
+	if len(excess) > 0 {
+		p.add(database, "revoke "+strings.ToLower(strings.Join(excess, ", "))+" on "+what+" from "+target.role, "%s", target.revoke(excess))
+	}
+}
+
+// databaseSpec merges the entries of one database across users: the owner
+// and seed directory (validated to be consistent), and every extension and
+// schema.
+type databaseSpec struct {
+	name       string
+	owner      string
+	seed       string
+	extensions []string
+	schemas    []string
+}
+
+func databaseSpecs(cfg *config.Config) []databaseSpec {
+	var specs []databaseSpec
+	index := make(map[string]int)
+	for _, user := range cfg.Postgres.Users {
+		for _, database := range user.Databases {
+			i, ok := index[database.Name]
+			if !ok {
+				i = len(specs)
+				index[database.Name] = i
+				specs = append(specs, databaseSpec{name: database.Name})
+			}
+			spec := &specs[i]
+			if database.Owner != "" {
+				spec.owner = database.Owner
+			}
+			if database.Seed != "" {
+				spec.seed = cfg.ResolvePath(database.Seed)
+			}
+			spec.extensions = appendMissing(spec.extensions, database.Extensions...)
+			spec.schemas = appendMissing(spec.schemas, database.Schemas...)
+		}
+	}
+	return specs
+}
+
+func appendMissing(list []string, values ...string) []string {
+	for _, value := range values {
+		if !slices.Contains(list, value) {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+// roleAttributes maps each configurable attribute to its pg_roles column
+// and the keyword turning it off.
+var roleAttributes = []struct {
+	name, column, off string
+}{
+	{"CREATEDB", "rolcreatedb", "NOCREATEDB"},
+	{"CREATEROLE", "rolcreaterole", "NOCREATEROLE"},
+	{"REPLICATION", "rolreplication", "NOREPLICATION"},
+	{"BYPASSRLS", "rolbypassrls", "NOBYPASSRLS"},
+	// NOINHERIT is listed by its "on" keyword: setting it turns rolinherit
+	// off.
+	{"NOINHERIT", "NOT rolinherit", "INHERIT"},
+}
+
+func wantedRoleAttributes(attributes []string) map[string]bool {
+	wanted := make(map[string]bool, len(roleAttributes))
+	for _, attribute := range roleAttributes {
+		wanted[attribute.name] = slices.Contains(attributes, attribute.name)
+	}
+	return wanted
+}
+
+func currentRoleAttributes(db *sql.DB, name string) (map[string]bool, error) {
+	columns := make([]string, 0, len(roleAttributes))
+	for _, attribute := range roleAttributes {
+		columns = append(columns, attribute.column)
+	}
+
+	values := make([]bool, len(roleAttributes))
+	targets := make([]any, len(values))
+	for i := range values {
+		targets[i] = &values[i]
+	}
+	query := "SELECT " + strings.Join(columns, ", ") + " FROM pg_roles WHERE rolname = $1"
+	if err := db.QueryRow(query, name).Scan(targets...); err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]bool, len(values))
+	for i, attribute := range roleAttributes {
+		current[attribute.name] = values[i]
+	}
+	return current, nil
+}
+
+// attributeClause lists the keywords turning current into wanted; with no
+// current state, only the attributes that are on are listed.
+func attributeClause(wanted, current map[string]bool) string {
+	var clause strings.Builder
+	for _, attribute := range roleAttributes {
+		on := wanted[attribute.name]
+		if current == nil {
+			if on {
+				clause.WriteString(" " + attribute.name)
+			}
+			continue
+		}
+		if current[attribute.name] == on {
+			continue
+		}
+		if on {
+			clause.WriteString(" " + attribute.name)
+		} else {
+			clause.WriteString(" " + attribute.off)
+		}
+	}
+	return clause.String()
+}
+
+func rowExists(db *sql.DB, query string, args ...any) (bool, error) {
+	var exists int
+	err := db.QueryRow(query, args...).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+const (
+	databaseGrantsQuery = `SELECT a.privilege_type
+FROM pg_database d
+CROSS JOIN LATERAL aclexplode(d.datacl) a
+JOIN pg_roles r ON r.oid = a.grantee
+WHERE d.datname = $1 AND r.rolname = $2`
+
+	schemaGrantsQuery = `SELECT a.privilege_type
+FROM pg_namespace n
+CROSS JOIN LATERAL aclexplode(n.nspacl) a
+JOIN pg_roles r ON r.oid = a.grantee
+WHERE n.nspname = $1 AND r.rolname = $2`
+
+	// defaultGrantsQuery reads the default privileges set for objects
+	// created by the role in $4.
+	defaultGrantsQuery = `SELECT a.privilege_type
+FROM pg_default_acl d
+JOIN pg_namespace n ON n.oid = d.defaclnamespace
+CROSS JOIN LATERAL aclexplode(d.defaclacl) a
+JOIN pg_roles r ON r.oid = a.grantee
+WHERE n.nspname = $1 AND d.defaclobjtype = $2 AND r.rolname = $3
+  AND d.defaclrole = (SELECT oid FROM pg_roles WHERE rolname = $4)`
+
+	// relationGrantsQuery lists every relation of a schema not owned by the
+	// role with the privileges granted to it, an empty privilege standing for
+	// none. A role that does not exist yet owns nothing and holds nothing.
+	relationGrantsQuery = `SELECT c.relname, COALESCE(a.privilege_type, '')
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+LEFT JOIN LATERAL (
+  SELECT x.privilege_type
+  FROM aclexplode(c.relacl) x
+  JOIN pg_roles r ON r.oid = x.grantee
+  WHERE r.rolname = $3
+) a ON true
+WHERE n.nspname = $1 AND c.relkind::text = ANY($2)
+  AND c.relowner IS DISTINCT FROM (SELECT oid FROM pg_roles WHERE rolname = $3)`
+)
+
+// pg_class.relkind values covered by ALL TABLES and ALL SEQUENCES.
+var (
+	tableKinds    = []string{"r", "p", "v", "m", "f"}
+	sequenceKinds = []string{"S"}
+)
+
+// grantedPrivileges runs a query listing privilege types.
+func grantedPrivileges(db *sql.DB, query string, args ...any) (map[string]bool, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	granted := make(map[string]bool)
+	for rows.Next() {
+		var privilege string
+		if err := rows.Scan(&privilege); err != nil {
+			return nil, err
+		}
+		granted[privilege] = true
+	}
+	return granted, rows.Err()
+}
+
+// passwordMatches checks password against the stored SCRAM-SHA-256 or MD5
+// verifier. When pg_authid is not readable the password is reported as
+// different, so it is always set.
+func passwordMatches(db *sql.DB, name, password string) (bool, error) {
+	var stored sql.NullString
+	err := db.QueryRow("SELECT rolpassword FROM pg_authid WHERE rolname = $1", name).Scan(&stored)
+	var pqErr *pq.Error
+	switch {
+	case errors.As(err, &pqErr) && pqErr.Code == "42501": // insufficient_privilege
+		return false, nil
+	case errors.Is(err, sql.ErrNoRows):
+		return false, nil
+	case err != nil:
+		return false, err
+	case !stored.Valid:
+		return false, nil
+	}
+
+	return postgresdep.VerifierMatches(stored.String, name, password), nil
+}
@@ -2,103 +2,178 @@ package sync
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
-	"strconv"
 
 	"github.com/lib/pq"
 	"github.com/yyewolf/kaloupile/pkg/config"
+	postgresdep "github.com/yyewolf/kaloupile/pkg/dependencies/postgresql"
 )
 
-func SyncPostgreSQL(cfg *config.Config) error {
+// SyncPostgreSQL plans the statements bringing PostgreSQL in line with
+// cfg.Postgres.Users and runs them. Transient failures, e.g. PostgreSQL still
+// starting, are retried with backoff until opts.RetryTimeout. With
+// opts.Prune, managed roles and databases no longer in config are dropped
+// afterwards, once confirmed.
+func SyncPostgreSQL(cfg *config.Config, opts Options) error {
 	if cfg == nil {
 		return fmt.Errorf("config is nil")
 	}
 
-	host := envOr("PGHOST", cfg.Postgres.LocalHost)
-	if host == "" {
-		host = "localhost"
-	}
-	port := envOr("PGPORT", "")
-	if port == "" {
-		if cfg.Postgres.Port > 0 {
-			port = strconv.Itoa(cfg.Postgres.LocalPort)
-		} else {
-			port = "5432"
-		}
+	r := newRetrier("postgresql", opts)
+	conns := newPGConnections(cfg)
+	defer conns.Close()
+
+	if err := r.do("connect admin database", func() error {
+		_, err := conns.admin()
+		return err
+	}); err != nil {
+		return err
 	}
-	sslmode := envOr("PGSSLMODE", "disable")
 
-	admin := cfg.Postgres.Admin
-	adminDB, err := openDB(host, port, admin.User, admin.Password, admin.Database, sslmode)
-	if err != nil {
+	var plan []Statement
+	if err := r.do("plan", func() error {
+		var err error
+		plan, err = planPostgreSQL(cfg, conns)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := applyStatements(conns, r, plan); err != nil {
 		return err
 	}
-	defer adminDB.Close()
 
-	if err := adminDB.Ping(); err != nil {
-		return fmt.Errorf("connect admin database: %w", err)
+	if !opts.Prune {
+		return nil
 	}
 
-	perDB := make(map[string]*sql.DB)
-	closeAll := func() {
-		for _, db := range perDB {
-			_ = db.Close()
-		}
+	var candidates []PruneObject
+	var drops []Statement
+	if err := r.do("plan prune", func() error {
+		var err error
+		candidates, drops, err = planPrune(cfg, conns)
+		return err
+	}); err != nil {
+		return err
+	}
+	if !confirmPrune(candidates, opts.ConfirmPrune) {
+		return nil
 	}
-	defer closeAll()
+	return applyStatements(conns, r, drops)
+}
 
-	for _, user := range cfg.Postgres.Users {
-		exists, err := userExists(adminDB, user.Name)
-		if err != nil {
-			return fmt.Errorf("check user %s: %w", user.Name, err)
-		}
+// PlanPostgreSQL returns the statements SyncPostgreSQL would run, prune
+// included with opts.Prune, without changing anything.
+func PlanPostgreSQL(cfg *config.Config, opts Options) ([]Statement, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
 
-		if exists {
-			if err := setUserPassword(adminDB, user.Name, user.Password); err != nil {
-				return fmt.Errorf("update user %s: %w", user.Name, err)
-			}
-		} else {
-			if err := createUser(adminDB, user.Name, user.Password); err != nil {
-				return fmt.Errorf("create user %s: %w", user.Name, err)
-			}
+	r := newRetrier("postgresql", opts)
+	conns := newPGConnections(cfg)
+	defer conns.Close()
+
+	var plan []Statement
+	if err := r.do("plan", func() error {
+		var err error
+		plan, err = planPostgreSQL(cfg, conns)
+		if err != nil || !opts.Prune {
+			return err
 		}
+		_, drops, err := planPrune(cfg, conns)
+		plan = append(plan, drops...)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
 
-		for _, dbName := range user.Databases {
-			exists, err := databaseExists(adminDB, dbName)
+func applyStatements(conns *pgConnections, r *retrier, statements []Statement) error {
+	for _, statement := range statements {
+		if err := r.do(statement.Description, func() error {
+			db, err := conns.db(statement.Database)
 			if err != nil {
-				return fmt.Errorf("check database %s: %w", dbName, err)
+				return err
 			}
+			_, err = db.Exec(statement.SQL)
+			return ignoreDuplicate(err)
+		}); err != nil {
+			return fmt.Errorf("%s: %w", statement.Description, err)
+		}
+	}
+	return nil
+}
 
-			if !exists {
-				if err := createDatabase(adminDB, dbName); err != nil {
-					return fmt.Errorf("create database %s: %w", dbName, err)
-				}
-			}
+// ignoreDuplicate drops "already exists" errors so that a retried CREATE whose
+// first attempt succeeded without an answer does not fail the sync.
+func ignoreDuplicate(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && (pqErr.Code == "42710" || pqErr.Code == "42P04") {
+		return nil
+	}
+	return err
+}
 
-			if err := grantDatabasePrivileges(adminDB, dbName, user.Name); err != nil {
-				return fmt.Errorf("grant database %s: %w", dbName, err)
-			}
+func openAdminDB(cfg *config.Config) (*sql.DB, error) {
+	host, port, sslmode := postgresdep.ConnectionParams(cfg)
+	admin := cfg.Postgres.Admin
+	db, err := postgresdep.OpenDB(host, port, admin.User, admin.Password, admin.Database, sslmode)
+	if err != nil {
+		return nil, err
+	}
 
-			targetDB, ok := perDB[dbName]
-			if !ok {
-				targetDB, err = openDB(host, port, admin.User, admin.Password, dbName, sslmode)
-				if err != nil {
-					return fmt.Errorf("open database %s: %w", dbName, err)
-				}
-				perDB[dbName] = targetDB
-				if err := targetDB.Ping(); err != nil {
-					return fmt.Errorf("connect database %s: %w", dbName, err)
-				}
-			}
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("connect admin database: %w", err)
+	}
 
-			if err := grantSchemaPrivileges(targetDB, user.Name); err != nil {
-				return fmt.Errorf("grant schema on %s: %w", dbName, err)
-			}
-		}
+	return db, nil
+}
+
+// pgConnections opens one admin connection pool per database on first use.
+type pgConnections struct {
+	cfg *config.Config
+	dbs map[string]*sql.DB
+}
+
+func newPGConnections(cfg *config.Config) *pgConnections {
+	return &pgConnections{cfg: cfg, dbs: make(map[string]*sql.DB)}
+}
+
+func (c *pgConnections) admin() (*sql.DB, error) {
+	return c.db("")
+}
+
+// db returns the pool for dbName, the admin database when empty.
+func (c *pgConnections) db(dbName string) (*sql.DB, error) {
+	admin := c.cfg.Postgres.Admin
+	if dbName == "" {
+		dbName = admin.Database
+	}
+	if db, ok := c.dbs[dbName]; ok {
+		return db, nil
 	}
 
-	return nil
+	host, port, sslmode := postgresdep.ConnectionParams(c.cfg)
+	db, err := postgresdep.OpenDB(host, port, admin.User, admin.Password, dbName, sslmode)
+	if err != nil {
+		return nil, fmt.Errorf("open database %s: %w", dbName, err)
+	}
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("connect database %s: %w", dbName, err)
+	}
+
+	c.dbs[dbName] = db
+	return db, nil
+}
+
+func (c *pgConnections) Close() {
+	for _, db := range c.dbs {
+		_ = db.Close()
+	}
 }
 
 func envOr(key, fallback string) string {
@@ -109,23 +184,6 @@ func envOr(key, fallback string) string {
 	return value
 }
 
-func openDB(host, port, user, password, dbName, sslmode string) (*sql.DB, error) {
-	if dbName == "" {
-		return nil, fmt.Errorf("database name is empty")
-	}
-
-	dsn := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
-		host,
-		port,
-		user,
-		password,
-		dbName,
-		sslmode,
-	)
-	return sql.Open("postgres", dsn)
-}
-
 func userExists(db *sql.DB, username string) (bool, error) {
 	var exists int
 	if err := db.QueryRow("SELECT 1 FROM pg_roles WHERE rolname=$1", username).Scan(&exists); err != nil {
@@ -147,48 +205,3 @@ func databaseExists(db *sql.DB, dbName string) (bool, error) {
 	}
 	return true, nil
 }
-
-func createUser(db *sql.DB, username, password string) error {
-	query := fmt.Sprintf("CREATE USER %s WITH PASSWORD %s", pq.QuoteIdentifier(username), pq.QuoteLiteral(password))
-	_, err := db.Exec(query)
-	return err
-}
-
-func setUserPassword(db *sql.DB, username, password string) error {
-	query := fmt.Sprintf("ALTER USER %s WITH PASSWORD %s", pq.QuoteIdentifier(username), pq.QuoteLiteral(password))
-	_, err := db.Exec(query)
-	return err
-}
-
-func createDatabase(db *sql.DB, dbName string) error {
-	query := fmt.Sprintf("CREATE DATABASE %s", pq.QuoteIdentifier(dbName))
-	_, err := db.Exec(query)
-	return err
-}
-
-func grantDatabasePrivileges(db *sql.DB, dbName, username string) error {
-	query := fmt.Sprintf(
-		"GRANT ALL PRIVILEGES ON DATABASE %s TO %s",
-		pq.QuoteIdentifier(dbName),
-		pq.QuoteIdentifier(username),
-	)
-	_, err := db.Exec(query)
-	return err
-}
-
-func grantSchemaPrivileges(db *sql.DB, username string) error {
-	userIdent := pq.QuoteIdentifier(username)
-	statements := []string{
-		fmt.Sprintf("GRANT ALL ON SCHEMA public TO %s", userIdent),
-		fmt.Sprintf("ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT ALL ON TABLES TO %s", userIdent),
-		fmt.Sprintf("ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT ALL ON SEQUENCES TO %s", userIdent),
-	}
-
-	for _, stmt := range statements {
-		if _, err := db.Exec(stmt); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
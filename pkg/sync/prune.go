@@ -0,0 +1,160 @@
+package sync
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/lib/pq"
+	"github.com/yyewolf/kaloupile/pkg/config"
+)
+
+// ManagedMarker is the comment kaloupile puts on the roles and databases it
+// creates. Prune only ever drops objects carrying it, so objects created by
+// hand are never touched.
+const ManagedMarker = "managed by kaloupile"
+
+// PruneObject is a role or database prune would drop.
+type PruneObject struct {
+	Kind string
+	Name string
+}
+
+func (o PruneObject) String() string {
+	return o.Kind + " " + o.Name
+}
+
+// pruneCandidates lists the managed databases and roles that are no longer
+// in config, databases first since they must be dropped before their owner.
+func pruneCandidates(db *sql.DB, cfg *config.Config) ([]PruneObject, error) {
+	wantedRoles := make(map[string]bool)
+	wantedDatabases := map[string]bool{cfg.Postgres.Admin.Database: true}
+	for _, user := range cfg.Postgres.Users {
+		wantedRoles[user.Name] = true
+		for _, database := range user.Databases {
+			wantedDatabases[database.Name] = true
+		}
+	}
+
+	databases, err := queryNames(db, "SELECT datname FROM pg_database WHERE shobj_description(oid, 'pg_database') = $1", ManagedMarker)
+	if err != nil {
+		return nil, fmt.Errorf("list managed databases: %w", err)
+	}
+	roles, err := queryNames(db, "SELECT rolname FROM pg_roles WHERE shobj_description(oid, 'pg_authid') = $1", ManagedMarker)
+	if err != nil {
+		return nil, fmt.Errorf("list managed roles: %w", err)
+	}
+
+	var objects []PruneObject
+	for _, name := range databases {
+		if !wantedDatabases[name] {
+			objects = append(objects, PruneObject{Kind: "database", Name: name})
+		}
+	}
+	for _, name := range roles {
+		if !wantedRoles[name] && name != cfg.Postgres.Admin.User {
+			objects = append(objects, PruneObject{Kind: "role", Name: name})
+		}
+	}
+	return objects, nil
+}
+
+func queryNames(db *sql.DB, query string, args ...any) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, rows.Err()
+}
+
+// planPrune lists the prune candidates and the statements dropping them.
+// Objects a pruned role owns in the remaining databases are reassigned to the
+// admin user rather than dropped.
+func planPrune(cfg *config.Config, conns *pgConnections) ([]PruneObject, []Statement, error) {
+	adminDB, err := conns.admin()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	candidates, err := pruneCandidates(adminDB, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var statements []Statement
+	dropped := make(map[string]bool)
+	var roles []string
+	for _, object := range candidates {
+		switch object.Kind {
+		case "database":
+			dropped[object.Name] = true
+			statements = append(statements, Statement{
+				Description: "drop database " + object.Name,
+				SQL:         fmt.Sprintf("DROP DATABASE IF EXISTS %s WITH (FORCE)", pq.QuoteIdentifier(object.Name)),
+			})
+		case "role":
+			roles = append(roles, object.Name)
+		}
+	}
+	if len(roles) == 0 {
+		return candidates, statements, nil
+	}
+
+	databases, err := connectableDatabases(adminDB)
+	if err != nil {
+		return nil, nil, fmt.Errorf("list databases: %w", err)
+	}
+
+	admin := pq.QuoteIdentifier(cfg.Postgres.Admin.User)
+	for _, name := range roles {
+		role := pq.QuoteIdentifier(name)
+		// DROP ROLE requires the role to own nothing and hold no privilege
+		// in any database.
+		for _, dbName := range databases {
+			if dropped[dbName] {
+				continue
+			}
+			statements = append(statements,
+				Statement{Database: dbName, Description: "reassign objects of " + name + " in " + dbName, SQL: fmt.Sprintf("REASSIGN OWNED BY %s TO %s", role, admin)},
+				Statement{Database: dbName, Description: "revoke privileges of " + name + " in " + dbName, SQL: fmt.Sprintf("DROP OWNED BY %s", role)},
+			)
+		}
+		statements = append(statements, Statement{Description: "drop role " + name, SQL: fmt.Sprintf("DROP ROLE IF EXISTS %s", role)})
+	}
+
+	return candidates, statements, nil
+}
+
+// confirmPrune lists the candidates and asks confirm before anything is
+// dropped.
+func confirmPrune(candidates []PruneObject, confirm func([]PruneObject) bool) bool {
+	if len(candidates) == 0 {
+		fmt.Println("[postgresql] nothing to prune")
+		return false
+	}
+
+	fmt.Println("[postgresql] the following objects are no longer in config and would be dropped:")
+	for _, object := range candidates {
+		fmt.Printf("[postgresql]   - %s\n", object)
+	}
+	if confirm == nil || !confirm(candidates) {
+		fmt.Println("[postgresql] prune not confirmed, keeping everything")
+		return false
+	}
+	return true
+}
+
+func connectableDatabases(db *sql.DB) ([]string, error) {
+	return queryNames(db, "SELECT datname FROM pg_database WHERE datallowconn AND NOT datistemplate")
+}
@@ -0,0 +1,143 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"github.com/yyewolf/kaloupile/pkg/dependencies"
+	redisdep "github.com/yyewolf/kaloupile/pkg/dependencies/redis"
+)
+
+// SyncRedis creates or updates every configured ACL user. Each user is reset
+// before its rules are applied, so prefixes and commands removed from the
+// config are revoked.
+func SyncRedis(cfg *config.Config, opts Options) error {
+	if cfg == nil {
+		return fmt.Errorf("config is nil")
+	}
+
+	ctx := context.Background()
+	r := newRetrier("redis", opts)
+
+	var client *goredis.Client
+	if err := r.do("connect", func() error {
+		var err error
+		client, err = openRedis(ctx, cfg)
+		return err
+	}); err != nil {
+		return err
+	}
+	defer client.Close()
+
+	for _, user := range cfg.Redis.Users {
+		args := []any{"ACL", "SETUSER", user.Name}
+		for _, rule := range redisUserRules(user) {
+			args = append(args, rule)
+		}
+		if err := r.do("set user "+user.Name, func() error {
+			return client.Do(ctx, args...).Err()
+		}); err != nil {
+			return fmt.Errorf("set redis user %s: %w", user.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// RedisStatus reports whether every configured ACL user exists, without
+// changing anything.
+func RedisStatus(cfg *config.Config) ([]ObjectStatus, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+
+	ctx := context.Background()
+	client, err := openRedis(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	var statuses []ObjectStatus
+	for _, user := range cfg.Redis.Users {
+		exists, err := redisUserExists(ctx, client, user.Name)
+		if err != nil {
+			return nil, fmt.Errorf("check redis user %s: %w", user.Name, err)
+		}
+		statuses = append(statuses, ObjectStatus{Kind: "user", Name: user.Name, Exists: exists})
+	}
+
+	return statuses, nil
+}
+
+// redisUserRules builds the ACL SETUSER rules for user. Key prefixes also
+// scope Pub/Sub channels; a user without prefixes is confined to "<name>:".
+func redisUserRules(user config.RedisUser) []string {
+	rules := []string{"reset", "on", ">" + user.Password}
+
+	prefixes := user.KeyPrefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{user.Name + ":"}
+	}
+	for _, prefix := range prefixes {
+		rules = append(rules, "~"+prefix+"*", "&"+prefix+"*")
+	}
+
+	return append(rules, strings.Fields(user.Commands)...)
+}
+
+func redisUserExists(ctx context.Context, client *goredis.Client, name string) (bool, error) {
+	err := client.Do(ctx, "ACL", "GETUSER", name).Err()
+	if errors.Is(err, goredis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// redisAddress resolves how to reach Redis from the host, honoring the
+// REDIS_HOST and REDIS_PORT overrides.
+func redisAddress(cfg *config.Config) string {
+	host := envOr("REDIS_HOST", cfg.Redis.LocalHost)
+	if host == "" {
+		host = "localhost"
+	}
+	port := envOr("REDIS_PORT", "")
+	if port == "" {
+		switch {
+		case cfg.Redis.LocalPort > 0:
+			port = strconv.Itoa(cfg.Redis.LocalPort)
+		default:
+			mapped := cfg.HostPort(dependencies.ClusterPortMappings(cfg), redisdep.NodePort)
+			if mapped == 0 {
+				mapped = 6379
+			}
+			port = strconv.Itoa(mapped)
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func openRedis(ctx context.Context, cfg *config.Config) (*goredis.Client, error) {
+	address := redisAddress(cfg)
+	client := goredis.NewClient(&goredis.Options{
+		Addr:     address,
+		Username: "default",
+		Password: cfg.Redis.Admin.Password,
+	})
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("connect redis %s: %w", address, err)
+	}
+
+	return client, nil
+}
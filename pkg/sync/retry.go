@@ -0,0 +1,155 @@
+package sync
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/yyewolf/kaloupile/pkg/config"
+)
+
+const (
+	// DefaultRetryTimeout covers a dependency pod (re)starting right before
+	// sync runs.
+	DefaultRetryTimeout = 3 * time.Minute
+
+	initialRetryDelay = 500 * time.Millisecond
+	maxRetryDelay     = 15 * time.Second
+)
+
+// PermanentError marks a failure that retrying cannot fix, such as bad
+// credentials.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// retrier retries operations with exponential backoff until a deadline
+// shared by every operation of one sync run.
+type retrier struct {
+	target   string
+	timeout  time.Duration
+	deadline time.Time
+}
+
+func newRetrier(target string, opts Options) *retrier {
+	return &retrier{target: target, timeout: opts.RetryTimeout, deadline: time.Now().Add(opts.RetryTimeout)}
+}
+
+func (r *retrier) do(what string, fn func() error) error {
+	delay := initialRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if !IsTransient(err) || r.timeout <= 0 {
+			return err
+		}
+
+		remaining := time.Until(r.deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("%s: gave up on %s after %s (%d attempts): %w", r.target, what, r.timeout, attempt, err)
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+
+		fmt.Printf("[%s] %s failed (%s), retrying in %s\n", r.target, what, config.Redact(err.Error()), delay.Round(time.Millisecond))
+		time.Sleep(delay)
+
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// IsTransient reports whether err is worth retrying: the server is not
+// reachable, still starting, restarting or temporarily overloaded.
+// Authentication, permission and query errors are permanent.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var permanentErr *PermanentError
+	if errors.As(err, &permanentErr) {
+		return false
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code.Class() == "08", // connection exception
+			pqErr.Code.Class() == "53", // insufficient resources, e.g. too many connections
+			pqErr.Code == "57P01",      // admin_shutdown
+			pqErr.Code == "57P02",      // crash_shutdown
+			pqErr.Code == "57P03",      // cannot_connect_now, starting up
+			pqErr.Code == "40001",      // serialization_failure
+			pqErr.Code == "40P01",      // deadlock_detected
+			pqErr.Code == "55P03",      // lock_not_available
+			pqErr.Code == "55006":      // object_in_use, e.g. a template database with sessions
+			return true
+		}
+		return false
+	}
+
+	var s3Err *s3Error
+	if errors.As(err, &s3Err) {
+		return s3Err.Status >= 500 || s3Err.Code == "SlowDown"
+	}
+
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	// Redis replies and kubectl failures only carry text.
+	message := err.Error()
+	for _, marker := range []string{
+		"LOADING ",
+		"BUSY ",
+		"TRYAGAIN ",
+		"connection refused",
+		"connection reset",
+		"i/o timeout",
+		"TLS handshake timeout",
+		"the server is currently unable to handle the request",
+		"ServiceUnavailable",
+	} {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,270 @@
+package sync
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"github.com/yyewolf/kaloupile/pkg/dependencies"
+)
+
+const (
+	S3SecretsTemplatePath = "cluster/sync/s3-secrets.yaml"
+	S3Namespace           = "seaweedfs"
+	S3ConfigSecret        = "s3-config"
+	S3ConfigSecretKey     = "seaweedfs_s3_config"
+	// S3FilerStatefulSet serves the S3 API and only reads the identities at
+	// startup.
+	S3FilerStatefulSet = "seaweedfs-filer"
+)
+
+type s3Identity struct {
+	Name        string         `json:"name"`
+	Credentials []s3Credential `json:"credentials,omitempty"`
+	Actions     []string       `json:"actions"`
+}
+
+type s3Credential struct {
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+}
+
+// SyncS3Identities regenerates the SeaweedFS identities secret (admin,
+// per-service credentials and anonymous read access) and the S3 CSI driver
+// credentials, restarting the filer when the identities changed.
+func SyncS3Identities(cfg *config.Config, opts Options) error {
+	if cfg == nil {
+		return fmt.Errorf("config is nil")
+	}
+	if !s3Configured(cfg) {
+		fmt.Println("[s3] no s3 admin, buckets or credentials configured, skipping")
+		return nil
+	}
+	if err := dependencies.RequireKubectl(); err != nil {
+		return err
+	}
+
+	identities, err := S3IdentitiesConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	kubeContext := cfg.KubeContext()
+	r := newRetrier("s3", opts)
+
+	var current string
+	var exists bool
+	if err := r.do("read identities secret", func() error {
+		var err error
+		current, exists, err = currentS3IdentitiesConfig(kubeContext)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	rendered, err := dependencies.RenderTemplate(S3SecretsTemplatePath, map[string]string{
+		"IdentitiesConfig": identities,
+		"AccessKey":        cfg.S3.Admin.AccessKey,
+		"SecretKey":        cfg.S3.Admin.SecretKey,
+	})
+	if err != nil {
+		return err
+	}
+	if err := r.do("apply identities secret", func() error {
+		return dependencies.ApplyManifest(kubeContext, rendered)
+	}); err != nil {
+		return err
+	}
+
+	if exists && strings.TrimSpace(current) == identities {
+		return nil
+	}
+	return r.do("restart filer", func() error {
+		return restartS3Filer(kubeContext)
+	})
+}
+
+// SyncS3Buckets creates the configured buckets that do not exist yet. Buckets
+// are never deleted.
+func SyncS3Buckets(cfg *config.Config, opts Options) error {
+	if cfg == nil {
+		return fmt.Errorf("config is nil")
+	}
+	if len(cfg.S3.Buckets) == 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+	client, err := openS3(cfg)
+	if err != nil {
+		return err
+	}
+
+	r := newRetrier("s3", opts)
+
+	var existing []string
+	if err := r.do("list buckets", func() error {
+		var err error
+		existing, err = client.ListBuckets(ctx)
+		return err
+	}); err != nil {
+		return fmt.Errorf("list buckets on %s: %w", client.endpoint, err)
+	}
+	found := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		found[name] = true
+	}
+
+	for _, bucket := range cfg.S3.Buckets {
+		if found[bucket.Name] {
+			continue
+		}
+		if err := r.do("create bucket "+bucket.Name, func() error {
+			return client.CreateBucket(ctx, bucket.Name)
+		}); err != nil {
+			return fmt.Errorf("create bucket %s: %w", bucket.Name, err)
+		}
+		fmt.Printf("[s3] created bucket %s\n", bucket.Name)
+	}
+
+	return nil
+}
+
+// S3Status reports whether every configured bucket exists, without changing
+// anything.
+func S3Status(cfg *config.Config) ([]ObjectStatus, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	if len(cfg.S3.Buckets) == 0 {
+		return nil, nil
+	}
+
+	client, err := openS3(cfg)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := client.ListBuckets(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("list buckets on %s: %w", client.endpoint, err)
+	}
+	found := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		found[name] = true
+	}
+
+	statuses := make([]ObjectStatus, 0, len(cfg.S3.Buckets))
+	for _, bucket := range cfg.S3.Buckets {
+		statuses = append(statuses, ObjectStatus{Kind: "bucket", Name: bucket.Name, Exists: found[bucket.Name]})
+	}
+	return statuses, nil
+}
+
+// S3IdentitiesConfig renders the SeaweedFS identities JSON for cfg. Public
+// buckets are readable through the special "anonymous" identity.
+func S3IdentitiesConfig(cfg *config.Config) (string, error) {
+	identities := []s3Identity{{
+		Name:        "admin",
+		Credentials: []s3Credential{{AccessKey: cfg.S3.Admin.AccessKey, SecretKey: cfg.S3.Admin.SecretKey}},
+		Actions:     []string{"Admin", "Read", "Write", "List", "Tagging"},
+	}}
+
+	for _, credential := range cfg.S3.Credentials {
+		actions := []string{"Read", "List"}
+		if credential.Access == "readwrite" {
+			actions = append(actions, "Write", "Tagging")
+		}
+
+		var scoped []string
+		for _, bucket := range credential.Buckets {
+			for _, action := range actions {
+				scoped = append(scoped, action+":"+bucket)
+			}
+		}
+		identities = append(identities, s3Identity{
+			Name:        credential.Name,
+			Credentials: []s3Credential{{AccessKey: credential.AccessKey, SecretKey: credential.SecretKey}},
+			Actions:     scoped,
+		})
+	}
+
+	var anonymous []string
+	for _, bucket := range cfg.S3.Buckets {
+		if bucket.Access == "public-read" {
+			anonymous = append(anonymous, "Read:"+bucket.Name)
+		}
+	}
+	if len(anonymous) > 0 {
+		identities = append(identities, s3Identity{Name: "anonymous", Actions: anonymous})
+	}
+
+	data, err := json.Marshal(map[string][]s3Identity{"identities": identities})
+	if err != nil {
+		return "", fmt.Errorf("encode s3 identities: %w", err)
+	}
+	return string(data), nil
+}
+
+func s3Configured(cfg *config.Config) bool {
+	return cfg.S3.Admin.AccessKey != "" || len(cfg.S3.Buckets) > 0 || len(cfg.S3.Credentials) > 0
+}
+
+func currentS3IdentitiesConfig(kubeContext string) (string, bool, error) {
+	output, err := dependencies.RunKubectl(kubeContext, "get", "secret", S3ConfigSecret, "-n", S3Namespace, "-o", "jsonpath={.data."+S3ConfigSecretKey+"}")
+	if err != nil {
+		if dependencies.IsNotFound(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(output))
+	if err != nil {
+		return "", false, fmt.Errorf("decode secret %s/%s: %w", S3Namespace, S3ConfigSecret, err)
+	}
+	return string(decoded), true, nil
+}
+
+func restartS3Filer(kubeContext string) error {
+	_, err := dependencies.RunKubectl(kubeContext, "get", "statefulset", S3FilerStatefulSet, "-n", S3Namespace, "-o", "name")
+	if err != nil {
+		if dependencies.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	fmt.Printf("[s3] identities changed, restarting %s\n", S3FilerStatefulSet)
+	if _, err := dependencies.RunKubectl(kubeContext, "rollout", "restart", "statefulset/"+S3FilerStatefulSet, "-n", S3Namespace); err != nil {
+		return err
+	}
+	_, err = dependencies.RunKubectl(kubeContext, "rollout", "status", "statefulset/"+S3FilerStatefulSet, "-n", S3Namespace, "--timeout=180s")
+	return err
+}
+
+// s3Endpoint resolves the S3 API address from the host, honoring the
+// S3_ENDPOINT override so the bucket sync can target a local S3 instead.
+func s3Endpoint(cfg *config.Config) string {
+	if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	if cfg.S3.Endpoint != "" {
+		return cfg.S3.Endpoint
+	}
+
+	port := cfg.HostPort(dependencies.ClusterPortMappings(cfg), config.S3NodePort)
+	if port == 0 {
+		port = 8333
+	}
+	return fmt.Sprintf("http://localhost:%d", port)
+}
+
+func openS3(cfg *config.Config) (*s3Client, error) {
+	accessKey := envOr("S3_ACCESS_KEY", cfg.S3.Admin.AccessKey)
+	secretKey := envOr("S3_SECRET_KEY", cfg.S3.Admin.SecretKey)
+	return newS3Client(s3Endpoint(cfg), cfg.S3.Region, accessKey, secretKey)
+}
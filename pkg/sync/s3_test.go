@@ -0,0 +1,319 @@
+package sync
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"github.com/yyewolf/kaloupile/pkg/dependencies"
+	"gopkg.in/yaml.v3"
+)
+
+// fakeS3 is a local S3 stand-in that checks the Signature V4 of every
+// request against the credentials it knows, like SeaweedFS does.
+type fakeS3 struct {
+	t       *testing.T
+	region  string
+	secrets map[string]string
+
+	mu       sync.Mutex
+	buckets  []string
+	requests []string
+	bodies   map[string]string
+}
+
+func newFakeS3(t *testing.T, region string, buckets ...string) (*fakeS3, *httptest.Server) {
+	fake := &fakeS3{
+		t:       t,
+		region:  region,
+		secrets: map[string]string{"admin-access": "admin-secret"},
+		buckets: buckets,
+		bodies:  make(map[string]string),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.t.Errorf("read request body: %v", err)
+	}
+	if err := f.verify(r, body); err != nil {
+		writeS3Error(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	bucket := strings.Trim(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodGet && bucket == "":
+		var list strings.Builder
+		for _, name := range f.buckets {
+			fmt.Fprintf(&list, "<Bucket><Name>%s</Name></Bucket>", name)
+		}
+		fmt.Fprintf(w, `<ListAllMyBucketsResult><Owner><ID>admin</ID></Owner><Buckets>%s</Buckets></ListAllMyBucketsResult>`, list.String())
+	case r.Method == http.MethodPut && bucket == "taken":
+		writeS3Error(w, http.StatusConflict, "BucketAlreadyExists", "The requested bucket name is not available.")
+	case r.Method == http.MethodPut && slices.Contains(f.buckets, bucket):
+		writeS3Error(w, http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it.")
+	case r.Method == http.MethodPut && bucket != "":
+		f.buckets = append(f.buckets, bucket)
+		f.bodies[bucket] = string(body)
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method+" "+r.URL.Path)
+	}
+}
+
+var authorizationPattern = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=([^/]+)/(\d{8})/([^/]+)/s3/aws4_request, SignedHeaders=([a-z0-9;-]+), Signature=([0-9a-f]{64})$`)
+
+// verify recomputes the signature of r from what was received on the wire.
+func (f *fakeS3) verify(r *http.Request, body []byte) error {
+	match := authorizationPattern.FindStringSubmatch(r.Header.Get("Authorization"))
+	if match == nil {
+		return fmt.Errorf("malformed Authorization header %q", r.Header.Get("Authorization"))
+	}
+	accessKey, date, region, signedHeaders, signature := match[1], match[2], match[3], match[4], match[5]
+
+	secret, ok := f.secrets[accessKey]
+	if !ok {
+		return fmt.Errorf("unknown access key %s", accessKey)
+	}
+	if region != f.region {
+		return fmt.Errorf("signed for region %s, expected %s", region, f.region)
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	if !strings.HasPrefix(amzDate, date) {
+		return fmt.Errorf("X-Amz-Date %s does not match the credential date %s", amzDate, date)
+	}
+	sum := sha256.Sum256(body)
+	if payloadHash := hex.EncodeToString(sum[:]); r.Header.Get("X-Amz-Content-Sha256") != payloadHash {
+		return fmt.Errorf("X-Amz-Content-Sha256 does not match the body")
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	canonicalRequest := r.Method + "\n" + r.URL.EscapedPath() + "\n" + r.URL.RawQuery + "\n" +
+		canonicalHeaders.String() + "\n" + signedHeaders + "\n" + r.Header.Get("X-Amz-Content-Sha256")
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + date + "/" + region + "/s3/aws4_request\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{date, region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if expected := hex.EncodeToString(key); signature != expected {
+		return fmt.Errorf("signature %s, expected %s", signature, expected)
+	}
+	return nil
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code, message string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, message)
+}
+
+func TestS3ClientSignsRequests(t *testing.T) {
+	_, server := newFakeS3(t, "eu-west-1", "assets", "uploads")
+
+	client, err := newS3Client(server.URL, "eu-west-1", "admin-access", "admin-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buckets, err := client.ListBuckets(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(buckets, []string{"assets", "uploads"}) {
+		t.Fatalf("ListBuckets = %v, want [assets uploads]", buckets)
+	}
+
+	client, err = newS3Client(server.URL, "eu-west-1", "admin-access", "wrong-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.ListBuckets(context.Background())
+	var apiErr *s3Error
+	if !errors.As(err, &apiErr) || apiErr.Code != "SignatureDoesNotMatch" || apiErr.Status != http.StatusForbidden {
+		t.Fatalf("ListBuckets with a wrong secret = %v, want SignatureDoesNotMatch", err)
+	}
+}
+
+func TestNewS3ClientRejectsInvalidEndpoint(t *testing.T) {
+	if _, err := newS3Client("localhost:8333", "us-east-1", "admin-access", "admin-secret"); err == nil {
+		t.Fatal("newS3Client accepted an endpoint without a scheme")
+	}
+}
+
+func TestS3ClientCreateBucket(t *testing.T) {
+	fake, server := newFakeS3(t, "eu-west-1", "assets")
+
+	client, err := newS3Client(server.URL, "eu-west-1", "admin-access", "admin-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if err := client.CreateBucket(ctx, "uploads"); err != nil {
+		t.Fatalf("CreateBucket(uploads) = %v", err)
+	}
+	if body := fake.bodies["uploads"]; !strings.Contains(body, "<LocationConstraint>eu-west-1</LocationConstraint>") {
+		t.Fatalf("CreateBucket body = %q, want a eu-west-1 location constraint", body)
+	}
+
+	if err := client.CreateBucket(ctx, "assets"); err != nil {
+		t.Fatalf("CreateBucket on a bucket already owned = %v, want nil", err)
+	}
+
+	err = client.CreateBucket(ctx, "taken")
+	var apiErr *s3Error
+	if !errors.As(err, &apiErr) || apiErr.Code != "BucketAlreadyExists" {
+		t.Fatalf("CreateBucket on a bucket owned by someone else = %v, want BucketAlreadyExists", err)
+	}
+}
+
+func TestS3ClientCreateBucketWithoutLocationInDefaultRegion(t *testing.T) {
+	fake, server := newFakeS3(t, "us-east-1")
+
+	client, err := newS3Client(server.URL, "us-east-1", "admin-access", "admin-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CreateBucket(context.Background(), "uploads"); err != nil {
+		t.Fatal(err)
+	}
+	if body := fake.bodies["uploads"]; body != "" {
+		t.Fatalf("CreateBucket body = %q, want none in us-east-1", body)
+	}
+}
+
+func TestSyncS3BucketsCreatesMissingBuckets(t *testing.T) {
+	fake, server := newFakeS3(t, "us-east-1", "assets")
+	t.Setenv("S3_ENDPOINT", "")
+	t.Setenv("S3_ACCESS_KEY", "")
+	t.Setenv("S3_SECRET_KEY", "")
+
+	cfg := &config.Config{}
+	cfg.S3.Endpoint = server.URL
+	cfg.S3.Region = "us-east-1"
+	cfg.S3.Admin.AccessKey = "admin-access"
+	cfg.S3.Admin.SecretKey = "admin-secret"
+	cfg.S3.Buckets = []config.S3Bucket{
+		{Name: "assets", Access: "public-read"},
+		{Name: "uploads", Access: "private"},
+	}
+
+	if err := SyncS3Buckets(cfg, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"GET /", "PUT /uploads"}
+	if !slices.Equal(fake.requests, want) {
+		t.Fatalf("requests = %v, want %v", fake.requests, want)
+	}
+
+	statuses, err := S3Status(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if !status.Exists {
+			t.Fatalf("bucket %s missing after sync", status.Name)
+		}
+	}
+}
+
+func TestS3IdentitiesConfigPublicRead(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.S3.Admin.AccessKey = "admin-access"
+	cfg.S3.Admin.SecretKey = "admin-secret"
+	cfg.S3.Buckets = []config.S3Bucket{
+		{Name: "assets", Access: "public-read"},
+		{Name: "uploads", Access: "private"},
+	}
+	cfg.S3.Credentials = []config.S3Credential{
+		{Name: "basilic", AccessKey: "basilic-access", SecretKey: "basilic-secret", Buckets: []string{"uploads"}, Access: "readonly"},
+	}
+
+	identities, err := S3IdentitiesConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Identities []s3Identity `json:"identities"`
+	}
+	if err := json.Unmarshal([]byte(identities), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	actions := make(map[string][]string)
+	for _, identity := range decoded.Identities {
+		actions[identity.Name] = identity.Actions
+	}
+	if got, want := actions["anonymous"], []string{"Read:assets"}; !slices.Equal(got, want) {
+		t.Fatalf("anonymous actions = %v, want %v", got, want)
+	}
+	if got, want := actions["basilic"], []string{"Read:uploads", "List:uploads"}; !slices.Equal(got, want) {
+		t.Fatalf("basilic actions = %v, want %v", got, want)
+	}
+}
+
+func TestS3SecretsTemplateEscapesCredentials(t *testing.T) {
+	accessKey, secretKey := `admin"access`, `se\cret"\n: x`
+	rendered, err := dependencies.RenderTemplate(filepath.Join("..", "..", S3SecretsTemplatePath), map[string]string{
+		"IdentitiesConfig": `{"identities":[]}`,
+		"AccessKey":        accessKey,
+		"SecretKey":        secretKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type secret struct {
+		Metadata   struct{ Name string } `yaml:"metadata"`
+		StringData map[string]string     `yaml:"stringData"`
+	}
+	var secrets []secret
+	decoder := yaml.NewDecoder(strings.NewReader(string(rendered)))
+	for {
+		var secret secret
+		if err := decoder.Decode(&secret); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatalf("rendered secrets are not valid YAML: %v\n%s", err, rendered)
+		}
+		secrets = append(secrets, secret)
+	}
+
+	if len(secrets) != 2 || secrets[1].Metadata.Name != "aws-secret" {
+		t.Fatalf("rendered %d secrets, want s3-config and aws-secret:\n%s", len(secrets), rendered)
+	}
+	if got := secrets[1].StringData; got["key_id"] != accessKey || got["access_key"] != secretKey {
+		t.Fatalf("aws-secret stringData = %q, want key_id %q and access_key %q", got, accessKey, secretKey)
+	}
+}
@@ -0,0 +1,233 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/yyewolf/kaloupile/pkg/config"
+)
+
+// SeedTable records, in the public schema of every seeded database, the seed
+// files applied and their checksum.
+const SeedTable = "kaloupile_seeds"
+
+type seedFile struct {
+	name     string
+	content  string
+	checksum string
+}
+
+// SyncPostgreSQLSeeds applies the seed files of every database with a seed
+// directory that were not applied yet. A file whose content changed since it
+// was applied fails the sync before anything runs: seeds are migrations, edit
+// them by adding a new file or start over with ReseedDatabase.
+func SyncPostgreSQLSeeds(cfg *config.Config, opts Options) error {
+	if cfg == nil {
+		return fmt.Errorf("config is nil")
+	}
+
+	r := newRetrier("postgresql-seeds", opts)
+	conns := newPGConnections(cfg)
+	defer conns.Close()
+
+	for _, spec := range databaseSpecs(cfg) {
+		if spec.seed == "" {
+			continue
+		}
+		if err := seedDatabase(conns, r, spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReseedDatabase drops dbName, recreates it with SyncPostgreSQL and replays
+// its seed files.
+func ReseedDatabase(cfg *config.Config, dbName string, opts Options) error {
+	if cfg == nil {
+		return fmt.Errorf("config is nil")
+	}
+
+	specs := databaseSpecs(cfg)
+	i := slices.IndexFunc(specs, func(spec databaseSpec) bool { return spec.name == dbName })
+	if i < 0 {
+		return fmt.Errorf("database %s is not in postgres.users", dbName)
+	}
+
+	r := newRetrier("postgresql-seeds", opts)
+	conns := newPGConnections(cfg)
+	defer conns.Close()
+
+	if err := r.do("drop database "+dbName, func() error {
+		db, err := conns.admin()
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s WITH (FORCE)", pq.QuoteIdentifier(dbName)))
+		return err
+	}); err != nil {
+		return fmt.Errorf("drop database %s: %w", dbName, err)
+	}
+	fmt.Printf("[postgresql-seeds] dropped database %s\n", dbName)
+
+	opts.Prune = false
+	if err := SyncPostgreSQL(cfg, opts); err != nil {
+		return err
+	}
+	if specs[i].seed == "" {
+		return nil
+	}
+	return seedDatabase(conns, r, specs[i])
+}
+
+func seedDatabase(conns *pgConnections, r *retrier, spec databaseSpec) error {
+	files, err := readSeeds(spec.seed)
+	if err != nil {
+		return permanent(fmt.Errorf("read seeds of %s: %w", spec.name, err))
+	}
+
+	var applied map[string]string
+	if err := r.do("read applied seeds of "+spec.name, func() error {
+		db, err := conns.db(spec.name)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec("CREATE TABLE IF NOT EXISTS public." + SeedTable + " (name text PRIMARY KEY, checksum text NOT NULL, applied_at timestamptz NOT NULL DEFAULT now())"); err != nil {
+			return err
+		}
+		applied, err = appliedSeeds(db)
+		return err
+	}); err != nil {
+		return fmt.Errorf("read applied seeds of %s: %w", spec.name, err)
+	}
+
+	var edited []string
+	for _, file := range files {
+		if checksum, ok := applied[file.name]; ok && checksum != file.checksum {
+			edited = append(edited, file.name)
+		}
+	}
+	if len(edited) > 0 {
+		return permanent(fmt.Errorf("seed files of %s were edited after being applied: %s; revert them or run kaloupile db reseed %s", spec.name, strings.Join(edited, ", "), spec.name))
+	}
+
+	for name := range applied {
+		if !slices.ContainsFunc(files, func(file seedFile) bool { return file.name == name }) {
+			fmt.Printf("[postgresql-seeds] %s: %s was applied but is no longer in %s\n", spec.name, name, spec.seed)
+		}
+	}
+
+	for _, file := range files {
+		if _, ok := applied[file.name]; ok {
+			continue
+		}
+		if err := r.do("apply seed "+file.name, func() error {
+			db, err := conns.db(spec.name)
+			if err != nil {
+				return err
+			}
+			return applySeed(db, spec.owner, file)
+		}); err != nil {
+			return fmt.Errorf("apply seed %s to %s: %w", file.name, spec.name, err)
+		}
+		fmt.Printf("[postgresql-seeds] %s: applied %s\n", spec.name, file.name)
+	}
+	return nil
+}
+
+// applySeed runs file and records it in one transaction, as the database
+// owner when there is one so that it owns what the seed creates. A file
+// recorded by an earlier attempt whose commit was not acknowledged is
+// skipped.
+func applySeed(db *sql.DB, owner string, file seedFile) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var checksum string
+	err = tx.QueryRow("SELECT checksum FROM public."+SeedTable+" WHERE name = $1", file.name).Scan(&checksum)
+	switch {
+	case err == nil:
+		return nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return err
+	}
+
+	if owner != "" {
+		if _, err := tx.Exec("SET LOCAL ROLE " + pq.QuoteIdentifier(owner)); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(file.content); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("RESET ROLE"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO public."+SeedTable+" (name, checksum) VALUES ($1, $2)", file.name, file.checksum); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func appliedSeeds(db *sql.DB) (map[string]string, error) {
+	rows, err := db.Query("SELECT name, checksum FROM public." + SeedTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[string]string)
+	for rows.Next() {
+		var name, checksum string
+		if err := rows.Scan(&name, &checksum); err != nil {
+			return nil, err
+		}
+		applied[name] = checksum
+	}
+	return applied, rows.Err()
+}
+
+// readSeeds lists the .sql files directly in dir, sorted by name.
+func readSeeds(dir string) ([]seedFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []seedFile
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || filepath.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(content)
+		files = append(files, seedFile{name: entry.Name(), content: string(content), checksum: hex.EncodeToString(sum[:])})
+	}
+	// os.ReadDir already sorts by file name.
+	return files, nil
+}
+
+// SeedDirectories lists the seed directories of cfg, e.g. to watch them.
+func SeedDirectories(cfg *config.Config) []string {
+	var dirs []string
+	for _, spec := range databaseSpecs(cfg) {
+		if spec.seed != "" {
+			dirs = append(dirs, spec.seed)
+		}
+	}
+	return dirs
+}
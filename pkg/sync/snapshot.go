@@ -0,0 +1,278 @@
+package sync
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/yyewolf/kaloupile/pkg/config"
+	"github.com/yyewolf/kaloupile/pkg/dependencies"
+)
+
+// SnapshotMarker starts the comment of snapshot databases and is followed by
+// the time the snapshot was taken.
+const SnapshotMarker = "kaloupile snapshot taken "
+
+var snapshotNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// Snapshot is a copy of a database kept in the cluster as a database of its
+// own, named <database>@<name>, which cannot be connected to. Snapshots live
+// in postgresql-pvc and disappear with it.
+type Snapshot struct {
+	Database string
+	Name     string
+	Taken    time.Time
+	Size     int64
+}
+
+// SnapshotDatabaseName returns the name of the database holding a snapshot.
+func SnapshotDatabaseName(dbName, name string) string {
+	return dbName + "@" + name
+}
+
+// SnapshotDatabase copies dbName into a snapshot with CREATE DATABASE ...
+// TEMPLATE. The copy needs dbName to have no other sessions, so they are
+// terminated first. With export set, the snapshot is also written there with
+// pg_dump --format=custom, run in the postgresql pod.
+func SnapshotDatabase(cfg *config.Config, dbName, name, export string, opts Options) (Snapshot, error) {
+	if cfg == nil {
+		return Snapshot{}, fmt.Errorf("config is nil")
+	}
+	if err := requireConfiguredDatabase(cfg, dbName); err != nil {
+		return Snapshot{}, err
+	}
+	if name == "" {
+		name = time.Now().Format("20060102-150405")
+	}
+	snapshotDB := SnapshotDatabaseName(dbName, name)
+	if !snapshotNamePattern.MatchString(name) {
+		return Snapshot{}, fmt.Errorf("snapshot name %q must start with a lowercase letter or digit and contain only lowercase letters, digits, '_', '.' or '-'", name)
+	}
+	if len(snapshotDB) > 63 {
+		return Snapshot{}, fmt.Errorf("snapshot database name %s is longer than 63 bytes", snapshotDB)
+	}
+
+	r := newRetrier("postgresql", opts)
+	conns := newPGConnections(cfg)
+	defer conns.Close()
+
+	var db *sql.DB
+	if err := r.do("connect admin database", func() error {
+		var err error
+		db, err = conns.admin()
+		return err
+	}); err != nil {
+		return Snapshot{}, err
+	}
+
+	if exists, err := databaseExists(db, snapshotDB); err != nil {
+		return Snapshot{}, fmt.Errorf("check snapshot %s: %w", snapshotDB, err)
+	} else if exists {
+		return Snapshot{}, fmt.Errorf("snapshot %s of %s already exists", name, dbName)
+	}
+
+	taken := time.Now().UTC().Truncate(time.Second)
+	if err := r.do("create snapshot "+snapshotDB, func() error {
+		owner, err := databaseOwner(db, dbName)
+		if err != nil {
+			return err
+		}
+		if err := terminateSessions(db, dbName); err != nil {
+			return err
+		}
+		_, err = db.Exec(fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s OWNER %s", pq.QuoteIdentifier(snapshotDB), pq.QuoteIdentifier(dbName), pq.QuoteIdentifier(owner)))
+		return ignoreDuplicate(err)
+	}); err != nil {
+		return Snapshot{}, fmt.Errorf("create snapshot %s: %w", snapshotDB, err)
+	}
+	if _, err := db.Exec(fmt.Sprintf("COMMENT ON DATABASE %s IS %s", pq.QuoteIdentifier(snapshotDB), pq.QuoteLiteral(SnapshotMarker+taken.Format(time.RFC3339)))); err != nil {
+		return Snapshot{}, fmt.Errorf("mark snapshot %s: %w", snapshotDB, err)
+	}
+
+	if export != "" {
+		if err := exportDatabase(cfg, snapshotDB, export); err != nil {
+			return Snapshot{}, err
+		}
+		fmt.Printf("[postgresql] exported %s to %s\n", snapshotDB, export)
+	}
+
+	// Snapshots are only ever used as templates, which must not be modified.
+	if _, err := db.Exec(fmt.Sprintf("ALTER DATABASE %s WITH ALLOW_CONNECTIONS false", pq.QuoteIdentifier(snapshotDB))); err != nil {
+		return Snapshot{}, fmt.Errorf("lock snapshot %s: %w", snapshotDB, err)
+	}
+
+	snapshot := Snapshot{Database: dbName, Name: name, Taken: taken}
+	if err := db.QueryRow("SELECT pg_database_size($1)", snapshotDB).Scan(&snapshot.Size); err != nil {
+		return Snapshot{}, fmt.Errorf("size of snapshot %s: %w", snapshotDB, err)
+	}
+	return snapshot, nil
+}
+
+// RestoreDatabase replaces dbName with a copy of its snapshot, then runs
+// SyncPostgreSQL to restore what CREATE DATABASE does not copy, such as the
+// database grants.
+func RestoreDatabase(cfg *config.Config, dbName, name string, opts Options) error {
+	if cfg == nil {
+		return fmt.Errorf("config is nil")
+	}
+	if err := requireConfiguredDatabase(cfg, dbName); err != nil {
+		return err
+	}
+	snapshotDB := SnapshotDatabaseName(dbName, name)
+
+	r := newRetrier("postgresql", opts)
+	conns := newPGConnections(cfg)
+	defer conns.Close()
+
+	var snapshots []Snapshot
+	if err := r.do("list snapshots", func() error {
+		db, err := conns.admin()
+		if err != nil {
+			return err
+		}
+		snapshots, err = listSnapshots(db, dbName)
+		return err
+	}); err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(snapshots, func(snapshot Snapshot) bool { return snapshot.Name == name }) {
+		return fmt.Errorf("no snapshot %s of %s, see kaloupile db snapshots %s", name, dbName, dbName)
+	}
+
+	db, err := conns.admin()
+	if err != nil {
+		return err
+	}
+	if err := r.do("drop database "+dbName, func() error {
+		_, err := db.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s WITH (FORCE)", pq.QuoteIdentifier(dbName)))
+		return err
+	}); err != nil {
+		return fmt.Errorf("drop database %s: %w", dbName, err)
+	}
+	if err := r.do("restore "+snapshotDB, func() error {
+		owner, err := databaseOwner(db, snapshotDB)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s OWNER %s", pq.QuoteIdentifier(dbName), pq.QuoteIdentifier(snapshotDB), pq.QuoteIdentifier(owner)))
+		return ignoreDuplicate(err)
+	}); err != nil {
+		return fmt.Errorf("restore %s from %s: %w", dbName, snapshotDB, err)
+	}
+	if _, err := db.Exec(fmt.Sprintf("COMMENT ON DATABASE %s IS %s", pq.QuoteIdentifier(dbName), pq.QuoteLiteral(ManagedMarker))); err != nil {
+		return fmt.Errorf("mark database %s: %w", dbName, err)
+	}
+	fmt.Printf("[postgresql] restored %s from snapshot %s\n", dbName, name)
+
+	opts.Prune = false
+	return SyncPostgreSQL(cfg, opts)
+}
+
+// ListSnapshots returns the snapshots of dbName, or of every database when
+// it is empty, ordered by database and name.
+func ListSnapshots(cfg *config.Config, dbName string, opts Options) ([]Snapshot, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+
+	r := newRetrier("postgresql", opts)
+	conns := newPGConnections(cfg)
+	defer conns.Close()
+
+	var snapshots []Snapshot
+	err := r.do("list snapshots", func() error {
+		db, err := conns.admin()
+		if err != nil {
+			return err
+		}
+		snapshots, err = listSnapshots(db, dbName)
+		return err
+	})
+	return snapshots, err
+}
+
+const snapshotsQuery = `SELECT d.datname, shobj_description(d.oid, 'pg_database'), pg_database_size(d.oid)
+FROM pg_database d
+WHERE shobj_description(d.oid, 'pg_database') LIKE $1 || '%'
+ORDER BY d.datname`
+
+func listSnapshots(db *sql.DB, dbName string) ([]Snapshot, error) {
+	rows, err := db.Query(snapshotsQuery, SnapshotMarker)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snapshots []Snapshot
+	for rows.Next() {
+		var datname, comment string
+		var size int64
+		if err := rows.Scan(&datname, &comment, &size); err != nil {
+			return nil, err
+		}
+		database, name, ok := strings.Cut(datname, "@")
+		if !ok || (dbName != "" && database != dbName) {
+			continue
+		}
+		// A comment edited by hand only loses the time.
+		taken, _ := time.Parse(time.RFC3339, strings.TrimPrefix(comment, SnapshotMarker))
+		snapshots = append(snapshots, Snapshot{Database: database, Name: name, Taken: taken, Size: size})
+	}
+	return snapshots, rows.Err()
+}
+
+func requireConfiguredDatabase(cfg *config.Config, dbName string) error {
+	if !slices.ContainsFunc(databaseSpecs(cfg), func(spec databaseSpec) bool { return spec.name == dbName }) {
+		return fmt.Errorf("database %s is not in postgres.users", dbName)
+	}
+	return nil
+}
+
+// terminateSessions closes every other session on dbName, which CREATE
+// DATABASE ... TEMPLATE requires. Applications reconnect on their own.
+func terminateSessions(db *sql.DB, dbName string) error {
+	var terminated int
+	if err := db.QueryRow("SELECT count(pg_terminate_backend(pid)) FROM pg_stat_activity WHERE datname = $1 AND pid <> pg_backend_pid()", dbName).Scan(&terminated); err != nil {
+		return fmt.Errorf("terminate sessions on %s: %w", dbName, err)
+	}
+	if terminated > 0 {
+		fmt.Printf("[postgresql] closed %d session(s) on %s\n", terminated, dbName)
+	}
+	return nil
+}
+
+// databaseOwner returns the owner of dbName, which CREATE DATABASE would
+// otherwise set to the admin user.
+func databaseOwner(db *sql.DB, dbName string) (string, error) {
+	var owner string
+	if err := db.QueryRow("SELECT pg_get_userbyid(datdba) FROM pg_database WHERE datname = $1", dbName).Scan(&owner); err != nil {
+		return "", fmt.Errorf("owner of database %s: %w", dbName, err)
+	}
+	return owner, nil
+}
+
+// exportDatabase runs pg_dump in the postgresql pod, so its version always
+// matches the server, and writes the dump to path on the host.
+func exportDatabase(cfg *config.Config, dbName, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", path, err)
+	}
+
+	err = dependencies.RunKubectlTo(cfg.KubeContext(), file,
+		"exec", "-n", dependencies.Namespace, "deploy/postgresql", "--",
+		"pg_dump", "--format=custom", "--username", cfg.Postgres.Admin.User, "--dbname", dbName)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return fmt.Errorf("export %s: %w", dbName, err)
+	}
+	return nil
+}
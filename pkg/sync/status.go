@@ -0,0 +1,53 @@
+package sync
+
+import (
+	"fmt"
+
+	"github.com/yyewolf/kaloupile/pkg/config"
+)
+
+type ObjectStatus struct {
+	Kind   string
+	Name   string
+	Exists bool
+}
+
+// PostgreSQLStatus reports whether every configured user and database exists,
+// without changing anything.
+func PostgreSQLStatus(cfg *config.Config) ([]ObjectStatus, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+
+	adminDB, err := openAdminDB(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer adminDB.Close()
+
+	var statuses []ObjectStatus
+	seenDatabases := make(map[string]bool)
+	for _, user := range cfg.Postgres.Users {
+		exists, err := userExists(adminDB, user.Name)
+		if err != nil {
+			return nil, fmt.Errorf("check user %s: %w", user.Name, err)
+		}
+		statuses = append(statuses, ObjectStatus{Kind: "user", Name: user.Name, Exists: exists})
+
+		for _, database := range user.Databases {
+			dbName := database.Name
+			if seenDatabases[dbName] {
+				continue
+			}
+			seenDatabases[dbName] = true
+
+			exists, err := databaseExists(adminDB, dbName)
+			if err != nil {
+				return nil, fmt.Errorf("check database %s: %w", dbName, err)
+			}
+			statuses = append(statuses, ObjectStatus{Kind: "database", Name: dbName, Exists: exists})
+		}
+	}
+
+	return statuses, nil
+}